@@ -22,6 +22,7 @@ import (
 	"os"
 
 	"github.com/packethost/csi-packet/pkg/driver"
+	"github.com/packethost/csi-packet/pkg/packet"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -30,6 +31,7 @@ var (
 	endpoint       string
 	nodeID         string
 	providerConfig string
+	options        driver.Options
 )
 
 func init() {
@@ -66,6 +68,57 @@ func main() {
 
 	cmd.PersistentFlags().StringVar(&providerConfig, "config", "", "path to provider config file")
 
+	cmd.PersistentFlags().StringSliceVar(&options.NodeIDStrategies, "nodeid-strategy", driver.DefaultNodeIDStrategies,
+		"ordered node id strategies, any of device-id, hostname, ip; with device-id first the node reports its packet device uuid")
+
+	cmd.PersistentFlags().Int64Var(&options.MaxVolumesPerNode, "max-volumes-per-node", packet.MaxVolumesPerDevice,
+		"maximum number of volumes attached to a node, reported by the node and enforced by the controller")
+
+	cmd.PersistentFlags().BoolVar(&options.ForceDetach, "force-detach", false,
+		"detach a single-node volume from a device that is no longer active before attaching it elsewhere")
+
+	cmd.PersistentFlags().StringVar(&options.StateDir, "state-dir", driver.DefaultStateDir,
+		"directory in which the node records the volumes it has staged, which must persist across restarts")
+
+	cmd.PersistentFlags().StringVar(&options.Reconcile, "reconcile", driver.ReconcileReport,
+		"node startup clean up of iscsi sessions, multipath maps and bindings no staged volume owns: enabled, report or disabled")
+
+	cmd.PersistentFlags().StringVar(&options.Metadata.Endpoint, "metadata-url", packet.DefaultMetadataEndpoint,
+		"url of the packet metadata service")
+
+	cmd.PersistentFlags().DurationVar(&options.Metadata.Timeout, "metadata-timeout", packet.DefaultMetadataTimeout,
+		"timeout of each metadata request")
+
+	cmd.PersistentFlags().IntVar(&options.Metadata.Retries, "metadata-retries", packet.DefaultMetadataRetries,
+		"number of times a failed metadata request is retried")
+
+	cmd.PersistentFlags().DurationVar(&options.Metadata.CacheTTL, "metadata-cache-ttl", packet.DefaultMetadataCacheTTL,
+		"how long a metadata response is reused")
+
+	cmd.PersistentFlags().DurationVar(&options.DeviceWaitTimeout, "device-wait-timeout", driver.DefaultDeviceWaitTimeout,
+		"how long staging waits for a volume to appear in the metadata, and for its disk to appear after login")
+
+	cmd.PersistentFlags().IntVar(&options.MinPaths, "min-paths", 1,
+		"number of volume portals which must be logged in for staging to succeed")
+
+	cmd.PersistentFlags().DurationVar(&options.PortalLoginTimeout, "portal-login-timeout", driver.DefaultPortalLoginTimeout,
+		"timeout of the iscsi discovery and login at each portal")
+
+	cmd.PersistentFlags().StringVar(&options.MultipathBackend, "multipath-backend", driver.MultipathTool,
+		"how multipath maps are created: multipath runs the multipath tool, multipathd asks the daemon and checks the map's paths, dmsetup builds the map of the paths with the volume's scsi id itself, single-path uses the disk of one portal without a map, auto uses multipath if the host has it or else a single path")
+
+	cmd.PersistentFlags().StringVar(&options.ExecMode, "exec-mode", driver.ExecContainer,
+		"where the node runs iscsiadm, multipath, mkfs and the other host tools: container runs those of the image, nsenter those of the host in its mount namespace, which needs hostPID, chroot those of the host under --host-root")
+
+	cmd.PersistentFlags().StringVar(&options.HostRoot, "host-root", driver.DefaultHostRoot,
+		"where the host root filesystem is mounted into the node plugin, for --exec-mode=chroot")
+
+	cmd.PersistentFlags().StringVar(&options.HostLayout, "host-layout", driver.HostLayoutAuto,
+		"where the host keeps multipath, scsi_id, the multipath bindings and the disk links: auto detects it from the host os-release, classic uses /sbin and /lib, usr-merged uses /usr/sbin and /usr/lib")
+
+	cmd.PersistentFlags().StringSliceVar(&options.HostPaths, "host-path", nil,
+		"name=path of a tool which is not on the default path, such as iscsiadm=/usr/sbin/iscsiadm, or of a path of the host layout, named multipath, multipath-bindings, scsi_id or disk-by-path, may be repeated")
+
 	cmd.ParseFlags(os.Args[1:])
 	if err := cmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "%s", err.Error())
@@ -76,6 +129,9 @@ func main() {
 }
 
 func handle() {
-	d, _ := driver.NewPacketDriver(endpoint, nodeID, providerConfig)
+	d, err := driver.NewPacketDriver(endpoint, nodeID, providerConfig, options)
+	if err != nil {
+		log.Fatalf("Unable to create driver %v", err)
+	}
 	d.Run()
 }
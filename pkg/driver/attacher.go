@@ -1,28 +1,26 @@
 package driver
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	multipathTimeout  = 10 * time.Second
-	multipathExec     = "/sbin/multipath"
-	multipathBindings = "/etc/multipath/bindings"
-)
+const multipathTimeout = 10 * time.Second
 
 // generic execCommand function which logs on error
-func execCommand(command string, args ...string) ([]byte, error) {
-	out, err := exec.Command(command, args...).CombinedOutput()
+func (h nodeHost) execCommand(command string, args ...string) ([]byte, error) {
+	return h.execCommandContext(context.Background(), command, args...)
+}
+
+// execCommandContext is execCommand, killing the command if the context is done first
+func (h nodeHost) execCommandContext(ctx context.Context, command string, args ...string) ([]byte, error) {
+	out, err := runCommand(h.exec.command(ctx, command, args...))
 	if err != nil {
 		log.WithFields(log.Fields{"command": command, "args": strings.Join(args, " "), "out": string(out[:]), "error": err.Error()}).Error("Error")
 		return nil, err
@@ -31,14 +29,12 @@ func execCommand(command string, args ...string) ([]byte, error) {
 }
 
 // multipath hangs when run inside a container, but is safe to terminate
-func multipath(args ...string) (string, error) {
+func (h nodeHost) multipath(args ...string) (string, error) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), multipathTimeout)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, multipathExec, args...)
-
-	output, err := cmd.Output()
+	output, err := runCommand(h.exec.command(ctx, h.layout.multipathExec, args...))
 
 	if ctx.Err() == context.DeadlineExceeded {
 		log.WithFields(log.Fields{"timeout": multipathTimeout, "args": strings.Join(args, " ")}).Info("multipath timed out")
@@ -48,36 +44,21 @@ func multipath(args ...string) (string, error) {
 	return string(output), err
 }
 
-func getScsiID(devicePath string) (string, error) {
+func (h nodeHost) getScsiID(devicePath string) (string, error) {
 	args := []string{"-g", "-u", "-d", devicePath}
-	out, err := execCommand("/lib/udev/scsi_id", args...)
+	out, err := h.execCommand(h.layout.scsiID, args...)
 	if err != nil {
 		return "", err
 	}
-	return string(out), nil
+	return strings.TrimSpace(string(out)), nil
 }
 
 // look for file that matches portal, iqn, look up what it links to
-func getDevice(portal, iqn string) (string, error) {
-
-	pattern := fmt.Sprintf("%s*%s*%s*", "/dev/disk/by-path/", portal, iqn)
-
-	files, err := filepath.Glob(pattern)
-	if err != nil {
-		return "", err
-	}
-	if len(files) == 0 {
-		return "", fmt.Errorf("file not found for pattern %s", pattern)
-	}
-
-	file := files[0]
-	finfo, err := os.Lstat(file)
+func (h nodeHost) getDevice(portal, iqn string) (string, error) {
+	file, err := h.getDeviceLink(portal, iqn)
 	if err != nil {
 		return "", err
 	}
-	if finfo.Mode()&os.ModeSymlink == 0 {
-		return "", fmt.Errorf("file %s is not a link", file)
-	}
 	source, err := filepath.EvalSymlinks(file)
 	if err != nil {
 		log.Errorf("cannot get symlink for %s", file)
@@ -86,114 +67,113 @@ func getDevice(portal, iqn string) (string, error) {
 	return source, nil
 }
 
-func iscsiadminDiscover(ip string) error {
-	args := []string{"--mode", "discovery", "--portal", ip, "--type", "sendtargets", "--discover"}
-	_, err := execCommand("iscsiadm", args...)
-	return err
-}
+// getDeviceLink returns the udev link to the disk of the portal and iqn, which unlike the disk
+// is named the same after a restart
+func (h nodeHost) getDeviceLink(portal, iqn string) (string, error) {
 
-// iscsiadminHasSession checks to see if the session exists, may log an extraneous error if the seesion does not exist
-func iscsiadminHasSession(ip, iqn string) (bool, error) {
-	args := []string{"--mode", "session"}
-	out, err := execCommand("iscsiadm", args...)
-	if err != nil {
-		return false, nil // this is almost certainly "No active sessions"
-	}
-	pat, err := regexp.Compile(ip + ".*" + iqn)
-	if err != nil {
-		return false, err
-	}
-	lines := strings.Split(string(out[:]), "\n")
-	for _, line := range lines {
-		found := pat.FindString(line)
-		if found != "" {
-			return true, nil
-		}
-	}
-	return false, nil
-}
+	pattern := filepath.Join(h.layout.diskByPath, fmt.Sprintf("*%s*%s*", portal, iqn))
 
-func iscsiadminLogin(ip, iqn string) error {
-	hasSession, err := iscsiadminHasSession(ip, iqn)
+	files, err := filepath.Glob(pattern)
 	if err != nil {
-		return err
+		return "", err
 	}
-	if hasSession {
-		return nil
+	if len(files) == 0 {
+		return "", fmt.Errorf("file not found for pattern %s", pattern)
 	}
-	args := []string{"--mode", "node", "--portal", ip, "--targetname", iqn, "--login"}
-	_, err = execCommand("iscsiadm", args...)
-	return err
-}
 
-func iscsiadminLogout(ip, iqn string) error {
-	hasSession, err := iscsiadminHasSession(ip, iqn)
+	file := files[0]
+	finfo, err := os.Lstat(file)
 	if err != nil {
-		return err
+		return "", err
 	}
-	if !hasSession {
-		return nil
+	if finfo.Mode()&os.ModeSymlink == 0 {
+		return "", fmt.Errorf("file %s is not a link", file)
 	}
-	args := []string{"--mode", "node", "--portal", ip, "--targetname", iqn, "--logout"}
-	_, err = execCommand("iscsiadm", args...)
-	return err
+	return file, nil
 }
 
-// read the bindings from /etc/multipath/bindings
-// separating into keep/discard sets
-// return elements map from volume name to scsi id
-func readBindings() (map[string]string, map[string]string, error) {
-
-	var bindings = map[string]string{}
-	var discard = map[string]string{}
-
-	if _, err := os.Stat(multipathBindings); err != nil {
-		if os.IsNotExist(err) {
-			// file does not exist
-			return bindings, discard, nil
-		} else {
-			return nil, nil, err
+// devicePollInterval is the pause between looks for the disk of a new session
+var devicePollInterval = time.Second
+
+// waitForDevice waits for udev to create the link for the disk of an iscsi session, which follows the login,
+// returning the disk of whichever portal has one first; on timeout the error lists the iscsi links which were found
+func (h nodeHost) waitForDevice(ctx context.Context, iscsi ISCSI, portals []string, iqn string) (string, error) {
+	ticker := time.NewTicker(devicePollInterval)
+	defer ticker.Stop()
+	for attempt := 0; ; attempt++ {
+		// udev missed the disk or the session has not reported it, so the sessions are rescanned
+		if attempt > 0 {
+			for _, portal := range portals {
+				iscsi.Rescan(portal, iqn)
+			}
+		}
+		// settle returns once udev has processed the events of the login, or at its timeout
+		h.execCommand("udevadm", "settle", fmt.Sprintf("--timeout=%d", int(devicePollInterval.Seconds())+1))
+		for _, portal := range portals {
+			devicePath, err := h.getDevice(portal, iqn)
+			if err == nil {
+				return devicePath, nil
+			}
 		}
-	}
 
-	f, err := os.Open(multipathBindings)
-	if err != nil {
-		return nil, nil, err
-	}
-	defer f.Close()
-
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) > 0 && line[0] != '#' {
-			elements := strings.Fields(line)
-			if len(elements) == 2 {
-
-				if strings.HasPrefix(elements[0], "mpath") {
-					discard[elements[0]] = elements[1]
-				} else {
-					bindings[elements[0]] = elements[1]
-				}
+		select {
+		case <-ctx.Done():
+			found, _ := filepath.Glob(filepath.Join(h.layout.diskByPath, "*"+iqn+"*"))
+			if len(found) == 0 {
+				found, _ = filepath.Glob(filepath.Join(h.layout.diskByPath, "*iscsi*"))
 			}
+			return "", fmt.Errorf("timed out waiting for device of %s at %v, found %v", iqn, portals, found)
+		case <-ticker.C:
 		}
 	}
-
-	return bindings, discard, nil
 }
 
-// read the bindings to /etc/multipath/bindings
-func writeBindings(bindings map[string]string) error {
+// loginPortals discovers and logs in to the target at every portal in parallel, each bounded by the timeout,
+// and returns the portals with a session and the errors of the others
+func loginPortals(ctx context.Context, iscsi ISCSI, portals []string, iqn string, timeout time.Duration) ([]string, map[string]error) {
+	type result struct {
+		portal string
+		err    error
+	}
+	results := make(chan result, len(portals))
+	for _, portal := range portals {
+		go func(portal string) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			err := iscsi.Discover(ctx, portal)
+			if err == nil {
+				err = iscsi.Login(ctx, portal, iqn)
+			}
+			if err != nil && ctx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("timed out after %s, %v", timeout, err)
+			}
+			results <- result{portal: portal, err: err}
+		}(portal)
+	}
 
-	f, err := os.Create(multipathBindings)
-	if err != nil {
-		return err
+	live := []string{}
+	failed := map[string]error{}
+	for range portals {
+		r := <-results
+		if r.err != nil {
+			failed[r.portal] = r.err
+		} else {
+			live = append(live, r.portal)
+		}
 	}
-	defer f.Close()
+	return live, failed
+}
 
-	writer := bufio.NewWriter(f)
-	for name, id := range bindings {
-		writer.WriteString(fmt.Sprintf("%s %s\n", name, id))
+// loginSinglePortal discovers and logs in to the target at each portal in turn, each bounded by the timeout,
+// and returns the first portal with a session and the errors of those before it
+func loginSinglePortal(ctx context.Context, iscsi ISCSI, portals []string, iqn string, timeout time.Duration) ([]string, map[string]error) {
+	failed := map[string]error{}
+	for _, portal := range portals {
+		live, errs := loginPortals(ctx, iscsi, []string{portal}, iqn, timeout)
+		if len(live) > 0 {
+			return live, failed
+		}
+		failed[portal] = errs[portal]
 	}
-	writer.Flush()
-	return nil
+	return []string{}, failed
 }
@@ -0,0 +1,216 @@
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// bindingsMutex serializes access to the bindings file within the process, the fcntl lock on the
+// file serializes it with other processes, among them multipath and multipathd, but not with the
+// other goroutines of this one
+var bindingsMutex sync.Mutex
+
+// bindingLine is a line of the bindings file, alias and wwid are empty for comments and blank lines
+type bindingLine struct {
+	text  string
+	alias string
+	wwid  string
+}
+
+// bindingTable holds the lines of the multipath bindings file, keeping comments and ordering
+type bindingTable struct {
+	lines   []bindingLine
+	changed bool
+}
+
+func parseBindings(data []byte) (*bindingTable, error) {
+	table := &bindingTable{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := bindingLine{text: scanner.Text()}
+		if len(line.text) > 0 && line.text[0] != '#' {
+			elements := strings.Fields(line.text)
+			if len(elements) == 2 {
+				line.alias, line.wwid = elements[0], elements[1]
+			}
+		}
+		table.lines = append(table.lines, line)
+	}
+	return table, scanner.Err()
+}
+
+// get returns the wwid bound to the alias
+func (t *bindingTable) get(alias string) (string, bool) {
+	for _, line := range t.lines {
+		if line.alias == alias {
+			return line.wwid, true
+		}
+	}
+	return "", false
+}
+
+// set binds the alias to the wwid, in place if the alias is already bound
+func (t *bindingTable) set(alias, wwid string) {
+	line := bindingLine{text: fmt.Sprintf("%s %s", alias, wwid), alias: alias, wwid: wwid}
+	for i := range t.lines {
+		if t.lines[i].alias == alias {
+			if t.lines[i].wwid != wwid {
+				t.lines[i] = line
+				t.changed = true
+			}
+			return
+		}
+	}
+	t.lines = append(t.lines, line)
+	t.changed = true
+}
+
+// remove drops the binding of the alias
+func (t *bindingTable) remove(alias string) {
+	lines := t.lines[:0]
+	for _, line := range t.lines {
+		if line.alias == alias {
+			t.changed = true
+			continue
+		}
+		lines = append(lines, line)
+	}
+	t.lines = lines
+}
+
+// bindings returns the aliases bound, separating those multipath named by default
+func (t *bindingTable) bindings() (map[string]string, map[string]string) {
+	bindings := map[string]string{}
+	discards := map[string]string{}
+	for _, line := range t.lines {
+		if line.alias == "" {
+			continue
+		}
+		if strings.HasPrefix(line.alias, "mpath") {
+			discards[line.alias] = line.wwid
+		} else {
+			bindings[line.alias] = line.wwid
+		}
+	}
+	return bindings, discards
+}
+
+func (t *bindingTable) bytes() []byte {
+	var buffer bytes.Buffer
+	for _, line := range t.lines {
+		buffer.WriteString(line.text)
+		buffer.WriteString("\n")
+	}
+	return buffer.Bytes()
+}
+
+// bindingsPath is where the plugin finds the host's bindings file, which the host tools read
+func (h nodeHost) bindingsPath() string {
+	return h.exec.hostPath(h.layout.multipathBindings)
+}
+
+// openBindings opens the bindings file and takes the in-process mutex and the fcntl lock on the whole
+// file which multipath and multipathd take before they write it, a write lock if the file is to be
+// changed; without write, a missing file is returned as nil. The lock is held until the file is closed
+// by the returned function, and no other descriptor of the file may be closed meanwhile, since that
+// releases the process's fcntl locks
+func (h nodeHost) openBindings(write bool) (*os.File, func(), error) {
+	bindingsMutex.Lock()
+	flag, lockType := os.O_RDONLY, int16(syscall.F_RDLCK)
+	if write {
+		flag, lockType = os.O_RDWR|os.O_CREATE, syscall.F_WRLCK
+		if err := os.MkdirAll(filepath.Dir(h.bindingsPath()), 0755); err != nil {
+			bindingsMutex.Unlock()
+			return nil, nil, err
+		}
+	}
+	f, err := os.OpenFile(h.bindingsPath(), flag, 0600)
+	if os.IsNotExist(err) && !write {
+		return nil, bindingsMutex.Unlock, nil
+	}
+	if err != nil {
+		bindingsMutex.Unlock()
+		return nil, nil, err
+	}
+	lock := syscall.Flock_t{Type: lockType, Whence: io.SeekStart}
+	if err = syscall.FcntlFlock(f.Fd(), syscall.F_SETLKW, &lock); err != nil {
+		f.Close()
+		bindingsMutex.Unlock()
+		return nil, nil, err
+	}
+	return f, func() {
+		// closing the file releases the lock
+		f.Close()
+		bindingsMutex.Unlock()
+	}, nil
+}
+
+// loadBindings reads the locked bindings file, which may not exist yet
+func loadBindings(f *os.File) (*bindingTable, error) {
+	if f == nil {
+		return &bindingTable{}, nil
+	}
+	data, err := ioutil.ReadAll(io.NewSectionReader(f, 0, math.MaxInt64))
+	if err != nil {
+		return nil, err
+	}
+	return parseBindings(data)
+}
+
+// saveBindings rewrites the locked bindings file in place, as multipath does, so that the host tools
+// which have the file open keep writing to the file which is read
+func saveBindings(f *os.File, table *bindingTable) error {
+	data := table.bytes()
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return err
+	}
+	if err := f.Truncate(int64(len(data))); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// readBindings returns the bindings from the multipath bindings file, separating into keep/discard sets
+// of maps from alias to scsi id
+func (h nodeHost) readBindings() (map[string]string, map[string]string, error) {
+	f, unlock, err := h.openBindings(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	table, err := loadBindings(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	bindings, discards := table.bindings()
+	return bindings, discards, nil
+}
+
+// modifyBindings applies the change to the bindings while holding the locks, writing them only if changed
+func (h nodeHost) modifyBindings(change func(*bindingTable)) error {
+	f, unlock, err := h.openBindings(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	table, err := loadBindings(f)
+	if err != nil {
+		return err
+	}
+	change(table)
+	if !table.changed {
+		return nil
+	}
+	return saveBindings(f, table)
+}
@@ -4,7 +4,10 @@ import (
 	"github.com/packethost/packngo"
 	"github.com/pkg/errors"
 
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/packethost/csi-packet/pkg/packet"
@@ -14,15 +17,27 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+const (
+	// stateWaitTimeout bounds the wait for volume or attachment readiness when the request carries no deadline
+	stateWaitTimeout = 2 * time.Minute
+)
+
+// stateWaitInterval is the polling period for volume and attachment state
+var stateWaitInterval = 2 * time.Second
+
 var _ csi.ControllerServer = &PacketControllerServer{}
 
 type PacketControllerServer struct {
 	Provider packet.VolumeProvider
+	options  Options
+	nodes    *nodeResolver
 }
 
-func NewPacketControllerServer(provider packet.VolumeProvider) *PacketControllerServer {
+func NewPacketControllerServer(provider packet.VolumeProvider, options Options) *PacketControllerServer {
 	return &PacketControllerServer{
 		Provider: provider,
+		options:  options,
+		nodes:    newNodeResolver(provider, options.nodeIDStrategies()),
 	}
 }
 
@@ -57,6 +72,38 @@ func getSizeRequest(capacityRange *csi.CapacityRange) int {
 	return sizeRequestGiB
 }
 
+// storage class parameters which are passed on to the node as volume attributes
+const (
+	// fsTypeParameter names the filesystem to create, when not given by the volume capability
+	fsTypeParameter = "fsType"
+	// mkfsOptionsParameter holds extra options for mkfs, separated by whitespace
+	mkfsOptionsParameter = "mkfsOptions"
+)
+
+// publish info keys for the iscsi targets, so that the node need not consult the metadata service
+const (
+	publishInfoIQN = "IQN"
+	// publishInfoPortals holds the portal ips separated by commas
+	publishInfoPortals = "Portals"
+)
+
+// getVolumeAttributes selects the parameters that the node needs to format the volume
+func getVolumeAttributes(parameters map[string]string) (map[string]string, error) {
+	var attributes map[string]string
+	for _, key := range []string{fsTypeParameter, mkfsOptionsParameter} {
+		if value, ok := parameters[key]; ok && value != "" {
+			if attributes == nil {
+				attributes = map[string]string{}
+			}
+			attributes[key] = value
+		}
+	}
+	if fsType := attributes[fsTypeParameter]; fsType != "" && !supportedFsTypes[fsType] {
+		return nil, fmt.Errorf("fs type %s not supported", fsType)
+	}
+	return attributes, nil
+}
+
 func getPlanID(parameters map[string]string) string {
 
 	var planID string
@@ -91,6 +138,15 @@ func (controller *PacketControllerServer) CreateVolume(ctx context.Context, in *
 
 	sizeRequestGiB := getSizeRequest(in.CapacityRange)
 	planID := getPlanID(in.Parameters)
+	attributes, err := getVolumeAttributes(in.Parameters)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	for _, capability := range in.VolumeCapabilities {
+		if err := validateMountFlags(capability.GetMount().GetMountFlags()); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
 
 	logger.WithFields(log.Fields{"planID": planID, "sizeRequestGiB": sizeRequestGiB}).Info("Volume requested")
 
@@ -114,12 +170,17 @@ func (controller *PacketControllerServer) CreateVolume(ctx context.Context, in *
 			if volume.Plan.ID != planID {
 				return nil, status.Errorf(codes.AlreadyExists, "mismatch with existing volume %s, plan %+v, requested %s", in.Name, volume.Plan, planID)
 			}
+			if volume.State != packet.VolumeStateActive {
+				if err := controller.waitForVolume(ctx, volume.ID, volumeActive); err != nil {
+					return nil, err
+				}
+			}
 
 			out := csi.CreateVolumeResponse{
 				Volume: &csi.Volume{
 					CapacityBytes: int64(volume.Size) * packet.Gibi,
 					Id:            volume.ID,
-					Attributes:    nil,
+					Attributes:    attributes,
 				},
 			}
 			return &out, nil
@@ -147,11 +208,17 @@ func (controller *PacketControllerServer) CreateVolume(ctx context.Context, in *
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to read csi description from provider volume")
 	}
+	if volume.State != packet.VolumeStateActive {
+		logger.WithField("volume_id", volume.ID).Info("waiting for volume to become active")
+		if err := controller.waitForVolume(ctx, volume.ID, volumeActive); err != nil {
+			return nil, err
+		}
+	}
 	out := csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			CapacityBytes: int64(volume.Size) * packet.Gibi,
 			Id:            volume.ID,
-			Attributes:    nil,
+			Attributes:    attributes,
 		},
 	}
 
@@ -211,49 +278,291 @@ func (controller *PacketControllerServer) ControllerPublishVolume(ctx context.Co
 		return nil, errors.Errorf("bad status from get volume %s, %s", volumeID, httpResponse.Status)
 	}
 
-	nodes, httpResponse, err := controller.Provider.GetNodes()
+	nodeID, err := controller.nodes.resolve(csiNodeID)
 	if err != nil {
+		if errors.Cause(err) == errNodeNotFound {
+			return nil, status.Errorf(codes.NotFound, "%v", err)
+		}
 		return nil, err
 	}
-	if httpResponse.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("bad status from get nodes, %s", httpResponse.Status)
-	}
-	// for packet this should be an ip address but try hostnam as well first anyway
-	var nodeID string
-	for _, node := range nodes {
-		if node.Hostname == csiNodeID {
-			nodeID = node.ID
-			break
-		}
-		for _, ipAssignment := range node.Network {
-			if ipAssignment.Address == csiNodeID {
-				nodeID = node.ID
-				break
-			}
+	multiReader := in.VolumeCapability.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+	if !attachedTo(volume, nodeID) {
+		if err := controller.checkAttachmentConflict(ctx, volume, nodeID, multiReader); err != nil {
+			return nil, err
+		}
+		if err := controller.checkAttachmentLimit(nodeID); err != nil {
+			return nil, err
 		}
 	}
-	if nodeID == "" {
-		return nil, status.Errorf(codes.Unknown, "node not found for host/ip %s", csiNodeID)
+	// a device which may write is no longer recorded as a reader before it is attached,
+	// so that no reader is admitted alongside it
+	if !multiReader {
+		if err := controller.recordReader(volume, nodeID, false); err != nil {
+			return nil, err
+		}
 	}
 	attachment, httpResponse, err := controller.Provider.Attach(volumeID, nodeID)
 	if err != nil {
+		// the device may have been replaced, so resolve afresh on retry
+		controller.nodes.forget(csiNodeID)
 		return nil, status.Errorf(codes.Unknown, "error attempting to attach %s to %s, %v", volumeID, nodeID, err)
 	}
 	if httpResponse.StatusCode != http.StatusOK && httpResponse.StatusCode != http.StatusCreated {
+		controller.nodes.forget(csiNodeID)
 		return nil, status.Errorf(codes.Unknown, "bad status from attach volumes, %s", httpResponse.Status)
 	}
+	err = controller.waitForVolume(ctx, volumeID, func(volume *packngo.Volume) (bool, error) {
+		return volumeAttached(volume, attachment.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if multiReader {
+		if err := controller.recordReader(volume, nodeID, true); err != nil {
+			return nil, err
+		}
+	}
 
 	metadata := make(map[string]string)
 	metadata["AttachmentId"] = attachment.ID
 	metadata["VolumeId"] = volumeID
 	metadata["VolumeName"] = volume.Name
+
+	// the node falls back to the metadata service if the targets are not published
+	targets, httpResponse, err := controller.Provider.GetTargets(volumeID)
+	if err != nil || httpResponse.StatusCode != http.StatusOK {
+		log.WithFields(log.Fields{"volume_id": volumeID, "error": err}).Warn("volume targets not read")
+	} else if targets.IQN != "" && len(targets.IPs) > 0 {
+		metadata[publishInfoIQN] = targets.IQN
+		metadata[publishInfoPortals] = strings.Join(targets.IPs, ",")
+	}
+
 	response := &csi.ControllerPublishVolumeResponse{
 		PublishInfo: metadata,
 	}
 	return response, nil
 }
 
-// ControllerPublishVolume detaches a volume from a node
+// attachedTo reports whether the volume is attached to the device
+func attachedTo(volume *packngo.Volume, deviceID string) bool {
+	for _, attachment := range volume.Attachments {
+		if attachment.Device.ID == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// attachmentOf returns the id of the volume's attachment to the device, or empty if it is not attached
+func attachmentOf(volume *packngo.Volume, deviceID string) string {
+	for _, attachment := range volume.Attachments {
+		if attachment.Device.ID == deviceID {
+			return attachment.ID
+		}
+	}
+	return ""
+}
+
+// readOnlyAccessMode reports whether the capability grants read access only
+func readOnlyAccessMode(capability *csi.VolumeCapability) bool {
+	switch capability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
+
+// recordReader records in the volume description whether the device is attached for multi-node
+// read-only access; a volume whose description is not the driver's has no readers
+func (controller *PacketControllerServer) recordReader(volume *packngo.Volume, deviceID string, reader bool) error {
+	description, err := packet.ReadDescription(volume.Description)
+	if err != nil || !description.SetReader(deviceID, reader) {
+		return nil
+	}
+	serialized := description.String()
+	_, httpResponse, err := controller.Provider.Update(volume.ID, &packngo.VolumeUpdateRequest{Description: &serialized})
+	if err != nil {
+		return status.Errorf(codes.Unknown, "error recording access of %s to %s, %v", deviceID, volume.ID, err)
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return status.Errorf(codes.Unknown, "bad status from update volume, %s", httpResponse.Status)
+	}
+	volume.Description = serialized
+	return nil
+}
+
+// checkAttachmentConflict permits a volume attached to other devices to be attached once more
+// only if this is a read-only multi-node publish and every other device is recorded as attached
+// the same way. Otherwise the publish fails naming the current holder, unless force detach is
+// enabled and the holder is no longer an active device, in which case the stale attachment is
+// removed first
+func (controller *PacketControllerServer) checkAttachmentConflict(ctx context.Context, volume *packngo.Volume, deviceID string, multiReader bool) error {
+	holders := []*packngo.VolumeAttachment{}
+	for _, attachment := range volume.Attachments {
+		if attachment.Device.ID != deviceID {
+			holders = append(holders, attachment)
+		}
+	}
+	if len(holders) == 0 {
+		return nil
+	}
+	if multiReader {
+		description, _ := packet.ReadDescription(volume.Description)
+		writers := 0
+		for _, holder := range holders {
+			if !description.IsReader(holder.Device.ID) {
+				writers++
+			}
+		}
+		if writers == 0 {
+			return nil
+		}
+	}
+
+	if !controller.options.ForceDetach {
+		return status.Errorf(codes.FailedPrecondition, "volume %s is attached to device %s", volume.ID, holderNames(holders))
+	}
+
+	nodes, httpResponse, err := controller.Provider.GetNodes()
+	if err != nil {
+		return err
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return errors.Errorf("bad status from get nodes, %s", httpResponse.Status)
+	}
+	states := map[string]string{}
+	for _, node := range nodes {
+		states[node.ID] = node.State
+	}
+	for _, holder := range holders {
+		if state, ok := states[holder.Device.ID]; ok && state == packet.DeviceStateActive {
+			return status.Errorf(codes.FailedPrecondition, "volume %s is attached to active device %s", volume.ID, holderNames(holders))
+		}
+	}
+
+	logger := log.WithFields(log.Fields{"volume_id": volume.ID, "device_id": deviceID})
+	for _, holder := range holders {
+		logger.WithFields(log.Fields{"holder_device_id": holder.Device.ID, "state": states[holder.Device.ID]}).Warn("force detaching volume from inactive device")
+		httpResponse, err := controller.Provider.Detach(holder.ID)
+		if err != nil && (httpResponse == nil || httpResponse.StatusCode != http.StatusNotFound) {
+			return status.Errorf(codes.Unknown, "error force detaching %s from %s, %v", volume.ID, holder.Device.ID, err)
+		}
+	}
+	return controller.waitForVolume(ctx, volume.ID, func(volume *packngo.Volume) (bool, error) {
+		for _, holder := range holders {
+			if attachedTo(volume, holder.Device.ID) {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
+
+// holderNames describes the devices holding attachments, for error messages
+func holderNames(holders []*packngo.VolumeAttachment) string {
+	names := []string{}
+	for _, holder := range holders {
+		if holder.Device.Hostname != "" {
+			names = append(names, fmt.Sprintf("%s (%s)", holder.Device.ID, holder.Device.Hostname))
+		} else {
+			names = append(names, holder.Device.ID)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// checkAttachmentLimit refuses another attachment to a device already holding the maximum number of volumes
+func (controller *PacketControllerServer) checkAttachmentLimit(deviceID string) error {
+	volumes, httpResponse, err := controller.Provider.ListVolumesWithAttachments()
+	if err != nil {
+		return err
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return errors.Errorf("bad status from list volumes, %s", httpResponse.Status)
+	}
+	var attached int64
+	for i := range volumes {
+		if attachedTo(&volumes[i], deviceID) {
+			attached++
+		}
+	}
+	limit := controller.options.maxVolumesPerNode()
+	if attached >= limit {
+		return status.Errorf(codes.ResourceExhausted, "device %s already has %d volumes attached, the limit is %d", deviceID, attached, limit)
+	}
+	return nil
+}
+
+// volumeActive reports whether provisioning of the volume is complete
+func volumeActive(volume *packngo.Volume) (bool, error) {
+	switch volume.State {
+	case packet.VolumeStateActive:
+		return true, nil
+	case packet.VolumeStateFailed:
+		return false, status.Errorf(codes.Internal, "volume %s provisioning failed", volume.ID)
+	}
+	return false, nil
+}
+
+// volumeAttached reports whether the volume is active and lists the attachment
+func volumeAttached(volume *packngo.Volume, attachmentID string) (bool, error) {
+	active, err := volumeActive(volume)
+	if err != nil || !active {
+		return false, err
+	}
+	for _, attachment := range volume.Attachments {
+		if attachment.ID == attachmentID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// waitForVolume polls the volume until ready is satisfied, within the request deadline.
+// Running out of time yields DeadlineExceeded, or Unavailable if the provider could not be reached,
+// so that the caller retries rather than proceeding with a volume that is not yet usable
+func (controller *PacketControllerServer) waitForVolume(ctx context.Context, volumeID string, ready func(*packngo.Volume) (bool, error)) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, stateWaitTimeout)
+		defer cancel()
+	}
+	logger := log.WithFields(log.Fields{"volume_id": volumeID})
+
+	ticker := time.NewTicker(stateWaitInterval)
+	defer ticker.Stop()
+	var lastErr error
+	for {
+		volume, httpResponse, err := controller.Provider.Get(volumeID)
+		switch {
+		case err != nil:
+			lastErr = err
+		case httpResponse.StatusCode != http.StatusOK:
+			lastErr = errors.Errorf("bad status from get volume %s, %s", volumeID, httpResponse.Status)
+		default:
+			lastErr = nil
+			done, err := ready(volume)
+			if err != nil {
+				return err
+			}
+			if done {
+				return nil
+			}
+			logger.WithField("state", volume.State).Debug("volume not ready")
+		}
+
+		select {
+		case <-ctx.Done():
+			if lastErr != nil {
+				return status.Errorf(codes.Unavailable, "volume %s not ready, %v", volumeID, lastErr)
+			}
+			return status.Errorf(codes.DeadlineExceeded, "timed out waiting for volume %s", volumeID)
+		case <-ticker.C:
+		}
+	}
+}
+
+// ControllerUnpublishVolume detaches a volume from a node
 func (controller *PacketControllerServer) ControllerUnpublishVolume(ctx context.Context, in *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
 	if controller == nil || controller.Provider == nil {
 		return nil, status.Error(codes.Internal, "controller not configured")
@@ -265,8 +574,20 @@ func (controller *PacketControllerServer) ControllerUnpublishVolume(ctx context.
 		return nil, status.Error(codes.InvalidArgument, "VolumeId unspecified for ControllerUnpublishVolume")
 	}
 
-	nodeID := in.GetNodeId()
+	csiNodeID := in.GetNodeId()
 	volumeID := in.GetVolumeId()
+	logger := log.WithFields(log.Fields{"volume_id": volumeID, "node_id": csiNodeID})
+
+	cached := controller.nodes.cached(csiNodeID)
+	nodeID, err := controller.nodes.resolve(csiNodeID)
+	if err != nil {
+		if errors.Cause(err) == errNodeNotFound {
+			// a device that no longer exists holds no attachments
+			logger.Infof("%v, nothing to detach", err)
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+		return nil, err
+	}
 
 	volume, httpResponse, err := controller.Provider.Get(volumeID)
 	if err != nil {
@@ -278,15 +599,24 @@ func (controller *PacketControllerServer) ControllerUnpublishVolume(ctx context.
 	if httpResponse.StatusCode != http.StatusOK {
 		return nil, status.Errorf(codes.Unknown, "bad status from get volume %s, %s", volumeID, httpResponse.Status)
 	}
-	attachments := volume.Attachments
-	if attachments == nil {
-		return nil, status.Errorf(codes.Unknown, "cannot detach unattached volume %s", volumeID)
-	}
-	attachmentID := ""
-	for _, attachment := range attachments {
-		if attachment.Volume.ID == volumeID && attachment.Device.ID == nodeID {
-			attachmentID = attachment.ID
+	attachmentID := attachmentOf(volume, nodeID)
+	if attachmentID == "" && cached {
+		// the cached device may have been replaced, as by a reinstall, so resolve afresh before
+		// concluding that the volume is not attached
+		controller.nodes.forget(csiNodeID)
+		nodeID, err = controller.nodes.resolve(csiNodeID)
+		if err != nil {
+			if errors.Cause(err) == errNodeNotFound {
+				logger.Infof("%v, nothing to detach", err)
+				return &csi.ControllerUnpublishVolumeResponse{}, nil
+			}
+			return nil, err
 		}
+		attachmentID = attachmentOf(volume, nodeID)
+	}
+	if attachmentID == "" {
+		logger.WithField("device_id", nodeID).Info("volume not attached to device, nothing to detach")
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
 
 	httpResponse, err = controller.Provider.Detach(attachmentID)
@@ -299,6 +629,11 @@ func (controller *PacketControllerServer) ControllerUnpublishVolume(ctx context.
 	if httpResponse.StatusCode != http.StatusOK && httpResponse.StatusCode != http.StatusNotFound {
 		return nil, errors.Errorf("bad status from detach volume, %s", httpResponse.Status)
 	}
+	// a stale reader record is harmless, since a device is no longer recorded as a reader
+	// before it is attached to write
+	if err := controller.recordReader(volume, nodeID, false); err != nil {
+		logger.Warnf("%v", err)
+	}
 
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
@@ -323,6 +658,7 @@ func (controller *PacketControllerServer) ValidateVolumeCapabilities(ctx context
 	supported := []*csi.VolumeCapability_AccessMode{}
 	supported = append(supported, &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
 	supported = append(supported, &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY})
+	supported = append(supported, &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY})
 
 	resp := &csi.ValidateVolumeCapabilitiesResponse{
 		Supported: false,
@@ -330,6 +666,13 @@ func (controller *PacketControllerServer) ValidateVolumeCapabilities(ctx context
 
 	for _, cap := range in.VolumeCapabilities {
 
+		// volumes may be used through a filesystem or as raw block devices
+		switch cap.GetAccessType().(type) {
+		case *csi.VolumeCapability_Mount, *csi.VolumeCapability_Block, nil:
+		default:
+			return resp, nil
+		}
+
 		mode := cap.AccessMode
 		hasSupport := false
 		for _, supportedCap := range supported {
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/packethost/csi-packet/pkg/packet"
 	"github.com/packethost/csi-packet/pkg/test"
@@ -15,6 +16,8 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -36,6 +39,7 @@ func TestCreateVolume(t *testing.T) {
 		Size:        packet.DefaultVolumeSizeGi,
 		ID:          providerVolumeID,
 		Description: packet.NewVolumeDescription(csiVolumeName).String(),
+		State:       packet.VolumeStateActive,
 	}
 	resp := packngo.Response{
 		&http.Response{
@@ -46,7 +50,7 @@ func TestCreateVolume(t *testing.T) {
 	provider.EXPECT().ListVolumes().Return([]packngo.Volume{}, &resp, nil)
 	provider.EXPECT().Create(gomock.Any()).Return(&volume, &resp, nil)
 
-	controller := NewPacketControllerServer(provider)
+	controller := NewPacketControllerServer(provider, Options{})
 	volumeRequest := csi.CreateVolumeRequest{
 		VolumeCapabilities: []*csi.VolumeCapability{
 			&csi.VolumeCapability{
@@ -107,7 +111,7 @@ func runTestCreateVolume(t *testing.T, description string, volumeRequest csi.Cre
 		Create(MatchRequest(description, providerRequest)).
 		Return(&providerVolume, &resp, nil)
 
-	controller := NewPacketControllerServer(provider)
+	controller := NewPacketControllerServer(provider, Options{})
 
 	csiResp, err := controller.CreateVolume(context.TODO(), &volumeRequest)
 	assert.Nil(t, err, description)
@@ -152,6 +156,7 @@ func TestCreateVolumes(t *testing.T) {
 				Size:        173,
 				ID:          "5a3c678a-64a4-41ba-a03c-e7d74a96f06a",
 				Description: packet.NewVolumeDescription("pv-qT2QXcwbqPB3BAurt1ccs7g6SDVT0qLv").String(),
+				State:       packet.VolumeStateActive,
 			},
 			success: true,
 		},
@@ -182,6 +187,7 @@ func TestCreateVolumes(t *testing.T) {
 				Size:        packet.DefaultVolumeSizeGi,
 				ID:          "06e45c5c-8bd9-44fd-a9e4-1518105de113",
 				Description: packet.NewVolumeDescription("pv-61C4yMq09WV1ZpNIOBKHRQDKoZzyK7ZF").String(),
+				State:       packet.VolumeStateActive,
 			},
 			success: true,
 		},
@@ -212,6 +218,7 @@ func TestCreateVolumes(t *testing.T) {
 				Size:        packet.DefaultVolumeSizeGi,
 				ID:          "8c3b6f51-7045-44b8-ab6d-d6df7371471e",
 				Description: packet.NewVolumeDescription("pv-61C4yMq09WV1ZpNIOBKHRQDKoZzyK7ZF").String(),
+				State:       packet.VolumeStateActive,
 			},
 			success: true,
 		},
@@ -239,6 +246,7 @@ func TestCreateVolumes(t *testing.T) {
 				Size:        packet.DefaultVolumeSizeGi,
 				ID:          "a94ecff0-b221-4d2d-8dc4-432bed506941",
 				Description: packet.NewVolumeDescription("pv-61C4yMq09WV1ZpNIOBKHRQDKoZzyK7ZF").String(),
+				State:       packet.VolumeStateActive,
 			},
 			success: true,
 		},
@@ -261,6 +269,7 @@ func TestIdempotentCreateVolume(t *testing.T) {
 		Size:        packet.DefaultVolumeSizeGi,
 		ID:          providerVolumeID,
 		Description: packet.NewVolumeDescription(csiVolumeName).String(),
+		State:       packet.VolumeStateActive,
 		Plan: &packngo.Plan{
 			Name: packet.VolumePlanStandard,
 			ID:   packet.VolumePlanStandardID,
@@ -274,7 +283,7 @@ func TestIdempotentCreateVolume(t *testing.T) {
 	}
 	provider.EXPECT().ListVolumes().Return([]packngo.Volume{volumeAlreadyExisting}, &resp, nil)
 
-	controller := NewPacketControllerServer(provider)
+	controller := NewPacketControllerServer(provider, Options{})
 	volumeRequest := csi.CreateVolumeRequest{
 		Name: csiVolumeName,
 		CapacityRange: &csi.CapacityRange{
@@ -298,6 +307,154 @@ func TestIdempotentCreateVolume(t *testing.T) {
 	assert.Equal(t, volumeAlreadyExisting.ID, csiResp.GetVolume().Id)
 }
 
+func TestCreateVolumeAttributes(t *testing.T) {
+	csiVolumeName := "kubernetes-volume-request-0987654321"
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+	volume := packngo.Volume{
+		Size:        packet.DefaultVolumeSizeGi,
+		ID:          providerVolumeID,
+		Description: packet.NewVolumeDescription(csiVolumeName).String(),
+		State:       packet.VolumeStateActive,
+	}
+	resp := packngo.Response{
+		&http.Response{
+			StatusCode: http.StatusOK,
+		},
+		packngo.Rate{},
+	}
+	provider.EXPECT().ListVolumes().Return([]packngo.Volume{}, &resp, nil)
+	provider.EXPECT().Create(gomock.Any()).Return(&volume, &resp, nil)
+
+	controller := NewPacketControllerServer(provider, Options{})
+	volumeRequest := csi.CreateVolumeRequest{
+		Name: csiVolumeName,
+		VolumeCapabilities: []*csi.VolumeCapability{
+			&csi.VolumeCapability{
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		Parameters: map[string]string{
+			"plan":        packet.VolumePlanStandard,
+			"fsType":      "xfs",
+			"mkfsOptions": "-m crc=1",
+		},
+	}
+
+	csiResp, err := controller.CreateVolume(context.TODO(), &volumeRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"fsType": "xfs", "mkfsOptions": "-m crc=1"}, csiResp.GetVolume().GetAttributes())
+
+	volumeRequest.Parameters["fsType"] = "vfat"
+	_, err = controller.CreateVolume(context.TODO(), &volumeRequest)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	volumeRequest.Parameters["fsType"] = "ext4"
+	volumeRequest.VolumeCapabilities[0].AccessType = &csi.VolumeCapability_Mount{
+		Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"noatime", "suid"}},
+	}
+	_, err = controller.CreateVolume(context.TODO(), &volumeRequest)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestCreateVolumeWaitsForActive(t *testing.T) {
+	defer func(interval time.Duration) { stateWaitInterval = interval }(stateWaitInterval)
+	stateWaitInterval = time.Millisecond
+
+	csiVolumeName := "kubernetes-volume-request-0987654321"
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+	queued := packngo.Volume{
+		Size:        packet.DefaultVolumeSizeGi,
+		ID:          providerVolumeID,
+		Description: packet.NewVolumeDescription(csiVolumeName).String(),
+		State:       "queued",
+	}
+	active := queued
+	active.State = packet.VolumeStateActive
+	resp := packngo.Response{
+		&http.Response{
+			StatusCode: http.StatusOK,
+		},
+		packngo.Rate{},
+	}
+	provider.EXPECT().ListVolumes().Return([]packngo.Volume{}, &resp, nil)
+	provider.EXPECT().Create(gomock.Any()).Return(&queued, &resp, nil)
+	gomock.InOrder(
+		provider.EXPECT().Get(providerVolumeID).Return(&queued, &resp, nil),
+		provider.EXPECT().Get(providerVolumeID).Return(&active, &resp, nil),
+	)
+
+	controller := NewPacketControllerServer(provider, Options{})
+	volumeRequest := csi.CreateVolumeRequest{
+		Name: csiVolumeName,
+		VolumeCapabilities: []*csi.VolumeCapability{
+			&csi.VolumeCapability{
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}
+
+	csiResp, err := controller.CreateVolume(context.TODO(), &volumeRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, providerVolumeID, csiResp.GetVolume().Id)
+}
+
+func TestCreateVolumeDeadlineExceeded(t *testing.T) {
+	defer func(interval time.Duration) { stateWaitInterval = interval }(stateWaitInterval)
+	stateWaitInterval = time.Millisecond
+
+	csiVolumeName := "kubernetes-volume-request-0987654321"
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+	queued := packngo.Volume{
+		Size:        packet.DefaultVolumeSizeGi,
+		ID:          providerVolumeID,
+		Description: packet.NewVolumeDescription(csiVolumeName).String(),
+		State:       "queued",
+	}
+	resp := packngo.Response{
+		&http.Response{
+			StatusCode: http.StatusOK,
+		},
+		packngo.Rate{},
+	}
+	provider.EXPECT().ListVolumes().Return([]packngo.Volume{}, &resp, nil)
+	provider.EXPECT().Create(gomock.Any()).Return(&queued, &resp, nil)
+	provider.EXPECT().Get(providerVolumeID).Return(&queued, &resp, nil).AnyTimes()
+
+	controller := NewPacketControllerServer(provider, Options{})
+	volumeRequest := csi.CreateVolumeRequest{
+		Name: csiVolumeName,
+		VolumeCapabilities: []*csi.VolumeCapability{
+			&csi.VolumeCapability{
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 20*time.Millisecond)
+	defer cancel()
+	_, err := controller.CreateVolume(ctx, &volumeRequest)
+	assert.NotNil(t, err)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
+
 func TestListVolumes(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
@@ -313,7 +470,7 @@ func TestListVolumes(t *testing.T) {
 	}
 	provider.EXPECT().ListVolumes().Return([]packngo.Volume{}, &resp, nil)
 
-	controller := NewPacketControllerServer(provider)
+	controller := NewPacketControllerServer(provider, Options{})
 	volumeRequest := csi.ListVolumesRequest{}
 
 	csiResp, err := controller.ListVolumes(context.TODO(), &volumeRequest)
@@ -338,7 +495,7 @@ func TestDeleteVolume(t *testing.T) {
 	}
 	provider.EXPECT().Delete(providerVolumeID).Return(&resp, nil)
 
-	controller := NewPacketControllerServer(provider)
+	controller := NewPacketControllerServer(provider, Options{})
 	volumeRequest := csi.DeleteVolumeRequest{
 		VolumeId: providerVolumeID,
 	}
@@ -376,8 +533,9 @@ func TestPublishVolume(t *testing.T) {
 		},
 	}
 	volumeResp := packngo.Volume{
-		ID:   providerVolumeID,
-		Name: providerVolumeName,
+		ID:    providerVolumeID,
+		Name:  providerVolumeName,
+		State: packet.VolumeStateActive,
 		Attachments: []*packngo.VolumeAttachment{
 			&packngo.VolumeAttachment{
 				ID: attachmentID,
@@ -399,11 +557,16 @@ func TestPublishVolume(t *testing.T) {
 	}
 	provider.EXPECT().GetNodes().Return(nodeResp, &resp, nil)
 
-	provider.EXPECT().Get(providerVolumeID).Return(&volumeResp, &resp, nil)
+	provider.EXPECT().Get(providerVolumeID).Return(&volumeResp, &resp, nil).Times(2)
 
 	provider.EXPECT().Attach(providerVolumeID, nodeID).Return(&attachResp, &resp, nil)
+	targets := packet.VolumeTargets{
+		IQN: "iqn.2013-05.com.daterainc:tc:01:sn:b06f4c5b0ec7cbe6",
+		IPs: []string{"10.144.144.226", "10.144.145.66"},
+	}
+	provider.EXPECT().GetTargets(providerVolumeID).Return(&targets, &resp, nil)
 
-	controller := NewPacketControllerServer(provider)
+	controller := NewPacketControllerServer(provider, Options{})
 	volumeRequest := csi.ControllerPublishVolumeRequest{
 		VolumeId:         providerVolumeID,
 		NodeId:           csiNodeIP,
@@ -417,7 +580,302 @@ func TestPublishVolume(t *testing.T) {
 	assert.Equal(t, attachmentID, csiResp.PublishInfo["AttachmentId"])
 	assert.Equal(t, providerVolumeID, csiResp.PublishInfo["VolumeId"])
 	assert.Equal(t, providerVolumeName, csiResp.PublishInfo["VolumeName"])
+	assert.Equal(t, targets.IQN, csiResp.PublishInfo["IQN"])
+	assert.Equal(t, "10.144.144.226,10.144.145.66", csiResp.PublishInfo["Portals"])
+
+}
+
+func TestPublishVolumeDeviceIDStrategy(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+
+	resp := packngo.Response{
+		&http.Response{
+			StatusCode: http.StatusOK,
+		},
+		packngo.Rate{},
+	}
+	volumeResp := packngo.Volume{
+		ID:    providerVolumeID,
+		Name:  "name-assigned-by-provider",
+		State: packet.VolumeStateActive,
+		Attachments: []*packngo.VolumeAttachment{
+			&packngo.VolumeAttachment{
+				ID: attachmentID,
+				Device: packngo.Device{
+					ID: nodeID,
+				},
+			},
+		},
+	}
+	attachResp := packngo.VolumeAttachment{
+		ID: attachmentID,
+		Device: packngo.Device{
+			ID: nodeID,
+		},
+	}
+	// a device uuid is used as is, without consulting the device list
+	provider.EXPECT().Get(providerVolumeID).Return(&volumeResp, &resp, nil).Times(2)
+	provider.EXPECT().Attach(providerVolumeID, nodeID).Return(&attachResp, &resp, nil)
+	// without published targets the node falls back to the metadata service
+	provider.EXPECT().GetTargets(providerVolumeID).Return(nil, nil, fmt.Errorf("unavailable")).AnyTimes()
+
+	controller := NewPacketControllerServer(provider, Options{NodeIDStrategies: []string{NodeIDDeviceID, NodeIDHostname}})
+	volumeRequest := csi.ControllerPublishVolumeRequest{
+		VolumeId:         providerVolumeID,
+		NodeId:           nodeID,
+		VolumeCapability: &csi.VolumeCapability{},
+	}
+
+	csiResp, err := controller.ControllerPublishVolume(context.TODO(), &volumeRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, attachmentID, csiResp.PublishInfo["AttachmentId"])
+	assert.Empty(t, csiResp.PublishInfo["IQN"])
+
+	// anything else falls back to the hostname
+	nodeResp := []packngo.Device{
+		packngo.Device{
+			Hostname: csiNodeName,
+			ID:       nodeID,
+		},
+	}
+	provider.EXPECT().GetNodes().Return(nodeResp, &resp, nil)
+	provider.EXPECT().Get(providerVolumeID).Return(&volumeResp, &resp, nil).Times(2)
+	provider.EXPECT().Attach(providerVolumeID, nodeID).Return(&attachResp, &resp, nil)
+
+	volumeRequest.NodeId = csiNodeName
+	csiResp, err = controller.ControllerPublishVolume(context.TODO(), &volumeRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, attachmentID, csiResp.PublishInfo["AttachmentId"])
+
+	// and an ip address is not matched when that strategy is not selected
+	volumeRequest.NodeId = csiNodeIP
+	provider.EXPECT().GetNodes().Return(nodeResp, &resp, nil)
+	provider.EXPECT().Get(providerVolumeID).Return(&volumeResp, &resp, nil)
+	_, err = controller.ControllerPublishVolume(context.TODO(), &volumeRequest)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestPublishVolumeAttachmentLimit(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+
+	resp := packngo.Response{
+		&http.Response{
+			StatusCode: http.StatusOK,
+		},
+		packngo.Rate{},
+	}
+	unattached := packngo.Volume{
+		ID:    providerVolumeID,
+		Name:  "name-assigned-by-provider",
+		State: packet.VolumeStateActive,
+	}
+	attachedElsewhere := func(id string) packngo.Volume {
+		return packngo.Volume{
+			ID: id,
+			Attachments: []*packngo.VolumeAttachment{
+				&packngo.VolumeAttachment{
+					Device: packngo.Device{ID: nodeID},
+				},
+			},
+		}
+	}
+	projectVolumes := []packngo.Volume{
+		attachedElsewhere("0b0bc2a5-6c8e-4a53-9d86-6c4e0f3f0d01"),
+		attachedElsewhere("0b0bc2a5-6c8e-4a53-9d86-6c4e0f3f0d02"),
+		unattached,
+	}
+	provider.EXPECT().Get(providerVolumeID).Return(&unattached, &resp, nil)
+	provider.EXPECT().ListVolumesWithAttachments().Return(projectVolumes, &resp, nil)
+
+	controller := NewPacketControllerServer(provider, Options{
+		NodeIDStrategies:  []string{NodeIDDeviceID},
+		MaxVolumesPerNode: 2,
+	})
+	volumeRequest := csi.ControllerPublishVolumeRequest{
+		VolumeId:         providerVolumeID,
+		NodeId:           nodeID,
+		VolumeCapability: &csi.VolumeCapability{},
+	}
 
+	_, err := controller.ControllerPublishVolume(context.TODO(), &volumeRequest)
+	assert.NotNil(t, err)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestPublishVolumeMultiNodeReader(t *testing.T) {
+
+	readerNodeID := "8a2f7d3e-0b1c-4e5f-9a6b-7c8d9e0f1a2b"
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+
+	resp := packngo.Response{
+		&http.Response{
+			StatusCode: http.StatusOK,
+		},
+		packngo.Rate{},
+	}
+	created := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	description := packet.VolumeDescription{Name: "pvc-reader", Created: created, Readers: []string{readerNodeID}}
+	// already attached to another reader
+	volumeResp := packngo.Volume{
+		ID:          providerVolumeID,
+		Name:        "name-assigned-by-provider",
+		Description: description.String(),
+		State:       packet.VolumeStateActive,
+		Attachments: []*packngo.VolumeAttachment{
+			&packngo.VolumeAttachment{
+				ID:     "c5b3d4e6-1f2a-4b3c-8d9e-0a1b2c3d4e5f",
+				Device: packngo.Device{ID: readerNodeID},
+			},
+		},
+	}
+	attachResp := packngo.VolumeAttachment{
+		ID:     attachmentID,
+		Device: packngo.Device{ID: nodeID},
+	}
+	attachedResp := volumeResp
+	attachedResp.Attachments = append(attachedResp.Attachments, &attachResp)
+
+	controller := NewPacketControllerServer(provider, Options{NodeIDStrategies: []string{NodeIDDeviceID}})
+	mnroCap := &csi.VolumeCapability{
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+	}
+
+	// another reader may attach
+	gomock.InOrder(
+		provider.EXPECT().Get(providerVolumeID).Return(&volumeResp, &resp, nil),
+		provider.EXPECT().Get(providerVolumeID).Return(&attachedResp, &resp, nil),
+	)
+	provider.EXPECT().ListVolumesWithAttachments().Return([]packngo.Volume{volumeResp}, &resp, nil)
+	provider.EXPECT().Attach(providerVolumeID, nodeID).Return(&attachResp, &resp, nil)
+	provider.EXPECT().GetTargets(providerVolumeID).Return(&packet.VolumeTargets{}, &resp, nil)
+	readers := packet.VolumeDescription{Name: "pvc-reader", Created: created, Readers: []string{readerNodeID, nodeID}}.String()
+	provider.EXPECT().Update(providerVolumeID, &packngo.VolumeUpdateRequest{Description: &readers}).Return(&volumeResp, &resp, nil)
+
+	csiResp, err := controller.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         providerVolumeID,
+		NodeId:           nodeID,
+		VolumeCapability: mnroCap,
+		Readonly:         true,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, attachmentID, csiResp.PublishInfo["AttachmentId"])
+	assert.Equal(t, readers, volumeResp.Description)
+
+	// a writer may not
+	provider.EXPECT().Get(providerVolumeID).Return(&volumeResp, &resp, nil)
+	_, err = controller.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{
+		VolumeId: providerVolumeID,
+		NodeId:   nodeID,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// nor may a reader join a holder which is not recorded as a reader
+	writerResp := volumeResp
+	writerResp.Description = packet.VolumeDescription{Name: "pvc-reader", Created: created}.String()
+	provider.EXPECT().Get(providerVolumeID).Return(&writerResp, &resp, nil)
+	_, err = controller.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         providerVolumeID,
+		NodeId:           nodeID,
+		VolumeCapability: mnroCap,
+		Readonly:         true,
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestPublishVolumeWriterConflict(t *testing.T) {
+	defer func(interval time.Duration) { stateWaitInterval = interval }(stateWaitInterval)
+	stateWaitInterval = time.Millisecond
+
+	holderNodeID := "8a2f7d3e-0b1c-4e5f-9a6b-7c8d9e0f1a2b"
+	holderAttachmentID := "c5b3d4e6-1f2a-4b3c-8d9e-0a1b2c3d4e5f"
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+
+	resp := packngo.Response{
+		&http.Response{
+			StatusCode: http.StatusOK,
+		},
+		packngo.Rate{},
+	}
+	heldResp := packngo.Volume{
+		ID:    providerVolumeID,
+		Name:  "name-assigned-by-provider",
+		State: packet.VolumeStateActive,
+		Attachments: []*packngo.VolumeAttachment{
+			&packngo.VolumeAttachment{
+				ID:     holderAttachmentID,
+				Device: packngo.Device{ID: holderNodeID},
+			},
+		},
+	}
+	releasedResp := heldResp
+	releasedResp.Attachments = nil
+	attachResp := packngo.VolumeAttachment{
+		ID:     attachmentID,
+		Device: packngo.Device{ID: nodeID},
+	}
+	attachedResp := releasedResp
+	attachedResp.Attachments = []*packngo.VolumeAttachment{&attachResp}
+
+	volumeRequest := csi.ControllerPublishVolumeRequest{
+		VolumeId: providerVolumeID,
+		NodeId:   nodeID,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+
+	// without force detach the holder is reported
+	controller := NewPacketControllerServer(provider, Options{NodeIDStrategies: []string{NodeIDDeviceID}})
+	provider.EXPECT().Get(providerVolumeID).Return(&heldResp, &resp, nil)
+	_, err := controller.ControllerPublishVolume(context.TODO(), &volumeRequest)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), holderNodeID)
+
+	// with force detach an active holder is left alone
+	controller = NewPacketControllerServer(provider, Options{NodeIDStrategies: []string{NodeIDDeviceID}, ForceDetach: true})
+	provider.EXPECT().Get(providerVolumeID).Return(&heldResp, &resp, nil)
+	provider.EXPECT().GetNodes().Return([]packngo.Device{
+		packngo.Device{ID: holderNodeID, State: packet.DeviceStateActive},
+	}, &resp, nil)
+	_, err = controller.ControllerPublishVolume(context.TODO(), &volumeRequest)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// but an inactive holder is detached before attaching
+	gomock.InOrder(
+		provider.EXPECT().Get(providerVolumeID).Return(&heldResp, &resp, nil),
+		provider.EXPECT().GetNodes().Return([]packngo.Device{
+			packngo.Device{ID: holderNodeID, State: "inactive"},
+		}, &resp, nil),
+		provider.EXPECT().Detach(holderAttachmentID).Return(&resp, nil),
+		provider.EXPECT().Get(providerVolumeID).Return(&heldResp, &resp, nil),
+		provider.EXPECT().Get(providerVolumeID).Return(&releasedResp, &resp, nil),
+		provider.EXPECT().ListVolumesWithAttachments().Return([]packngo.Volume{releasedResp}, &resp, nil),
+		provider.EXPECT().Attach(providerVolumeID, nodeID).Return(&attachResp, &resp, nil),
+		provider.EXPECT().Get(providerVolumeID).Return(&attachedResp, &resp, nil),
+		provider.EXPECT().GetTargets(providerVolumeID).Return(&packet.VolumeTargets{}, &resp, nil),
+	)
+	csiResp, err := controller.ControllerPublishVolume(context.TODO(), &volumeRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, attachmentID, csiResp.PublishInfo["AttachmentId"])
 }
 
 func TestUnpublishVolume(t *testing.T) {
@@ -448,13 +906,21 @@ func TestUnpublishVolume(t *testing.T) {
 		},
 	}
 
+	nodeResp := []packngo.Device{
+		packngo.Device{
+			Hostname: csiNodeName,
+			ID:       nodeID,
+		},
+	}
+
+	provider.EXPECT().GetNodes().Return(nodeResp, &resp, nil)
 	provider.EXPECT().Get(providerVolumeID).Return(&attachedVolume, &resp, nil)
 	provider.EXPECT().Detach(attachmentID).Return(&resp, nil)
 
-	controller := NewPacketControllerServer(provider)
+	controller := NewPacketControllerServer(provider, Options{})
 	volumeRequest := csi.ControllerUnpublishVolumeRequest{
 		VolumeId: providerVolumeID,
-		NodeId:   nodeID,
+		NodeId:   csiNodeName,
 	}
 
 	csiResp, err := controller.ControllerUnpublishVolume(context.TODO(), &volumeRequest)
@@ -463,13 +929,162 @@ func TestUnpublishVolume(t *testing.T) {
 
 }
 
+func TestUnpublishVolumeNotAttached(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+
+	resp := packngo.Response{
+		&http.Response{
+			StatusCode: http.StatusOK,
+		},
+		packngo.Rate{},
+	}
+	nodeResp := []packngo.Device{
+		packngo.Device{
+			Hostname: csiNodeName,
+			ID:       nodeID,
+		},
+	}
+	otherAttachment := packngo.Volume{
+		ID: providerVolumeID,
+		Attachments: []*packngo.VolumeAttachment{
+			&packngo.VolumeAttachment{
+				ID: attachmentID,
+				Device: packngo.Device{
+					ID: "8a2f7d3e-0b1c-4e5f-9a6b-7c8d9e0f1a2b",
+				},
+			},
+		},
+	}
+
+	// the device list is consulted on the first call, and again when the cached resolution finds no attachment
+	provider.EXPECT().GetNodes().Return(nodeResp, &resp, nil).Times(2)
+	provider.EXPECT().Get(providerVolumeID).Return(&otherAttachment, &resp, nil).Times(2)
+
+	controller := NewPacketControllerServer(provider, Options{})
+	volumeRequest := csi.ControllerUnpublishVolumeRequest{
+		VolumeId: providerVolumeID,
+		NodeId:   csiNodeName,
+	}
+
+	for i := 0; i < 2; i++ {
+		csiResp, err := controller.ControllerUnpublishVolume(context.TODO(), &volumeRequest)
+		assert.Nil(t, err)
+		assert.NotNil(t, csiResp)
+	}
+
+	// an unknown node has nothing attached
+	volumeRequest.NodeId = "departed-node"
+	provider.EXPECT().GetNodes().Return(nodeResp, &resp, nil)
+	csiResp, err := controller.ControllerUnpublishVolume(context.TODO(), &volumeRequest)
+	assert.Nil(t, err)
+	assert.NotNil(t, csiResp)
+}
+
+func TestUnpublishVolumeStaleNode(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+
+	resp := packngo.Response{
+		&http.Response{
+			StatusCode: http.StatusOK,
+		},
+		packngo.Rate{},
+	}
+	reinstalledID := "8a2f7d3e-0b1c-4e5f-9a6b-7c8d9e0f1a2b"
+	attachedVolume := packngo.Volume{
+		ID: providerVolumeID,
+		Attachments: []*packngo.VolumeAttachment{
+			&packngo.VolumeAttachment{
+				ID: attachmentID,
+				Device: packngo.Device{
+					ID: reinstalledID,
+				},
+			},
+		},
+	}
+
+	// the hostname resolves to the old device, then to the device which replaced it
+	gomock.InOrder(
+		provider.EXPECT().GetNodes().Return([]packngo.Device{{Hostname: csiNodeName, ID: nodeID}}, &resp, nil),
+		provider.EXPECT().Get(providerVolumeID).Return(&packngo.Volume{ID: providerVolumeID}, &resp, nil),
+		provider.EXPECT().Get(providerVolumeID).Return(&attachedVolume, &resp, nil),
+		provider.EXPECT().GetNodes().Return([]packngo.Device{{Hostname: csiNodeName, ID: reinstalledID}}, &resp, nil),
+		provider.EXPECT().Detach(attachmentID).Return(&resp, nil),
+	)
+
+	controller := NewPacketControllerServer(provider, Options{})
+	volumeRequest := csi.ControllerUnpublishVolumeRequest{
+		VolumeId: providerVolumeID,
+		NodeId:   csiNodeName,
+	}
+	for i := 0; i < 2; i++ {
+		_, err := controller.ControllerUnpublishVolume(context.TODO(), &volumeRequest)
+		assert.Nil(t, err)
+	}
+}
+
+func TestNodeResolverUnlockedLookup(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+
+	resp := packngo.Response{
+		&http.Response{
+			StatusCode: http.StatusOK,
+		},
+		packngo.Rate{},
+	}
+	retrieving, release := make(chan struct{}), make(chan struct{})
+	provider.EXPECT().GetNodes().DoAndReturn(func() ([]packngo.Device, *packngo.Response, error) {
+		close(retrieving)
+		<-release
+		return []packngo.Device{{Hostname: csiNodeName, ID: nodeID}}, &resp, nil
+	})
+
+	resolver := newNodeResolver(provider, []string{NodeIDHostname})
+	resolver.devices["cached-node"] = "8a2f7d3e-0b1c-4e5f-9a6b-7c8d9e0f1a2b"
+	resolved := make(chan string)
+	go func() {
+		deviceID, err := resolver.resolve(csiNodeName)
+		assert.Nil(t, err)
+		resolved <- deviceID
+	}()
+
+	// while the device list is retrieved, a cached node resolves
+	<-retrieving
+	looked := make(chan string)
+	go func() {
+		deviceID, _ := resolver.resolve("cached-node")
+		looked <- deviceID
+	}()
+	select {
+	case deviceID := <-looked:
+		assert.Equal(t, "8a2f7d3e-0b1c-4e5f-9a6b-7c8d9e0f1a2b", deviceID)
+	case <-time.After(time.Second):
+		t.Fatal("the cached node waits for the device list")
+	}
+
+	close(release)
+	assert.Equal(t, nodeID, <-resolved)
+	assert.True(t, resolver.cached(csiNodeName))
+}
+
 func TestGetCapacity(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 	provider := test.NewMockVolumeProvider(mockCtrl)
 
 	capacityRequest := csi.GetCapacityRequest{}
-	controller := NewPacketControllerServer(provider)
+	controller := NewPacketControllerServer(provider, Options{})
 	csiResp, err := controller.GetCapacity(context.TODO(), &capacityRequest)
 	assert.NotNil(t, err, "this method is not implemented")
 	assert.Nil(t, csiResp, "this method is not implemented")
@@ -498,6 +1113,18 @@ func getVolumeCapabilityTestCases() []volumeCapabilityTestCase {
 	mnswCap := csi.VolumeCapability{
 		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER},
 	}
+	snwBlockCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	mnroBlockCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+	}
+	snwMountCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
 
 	return []volumeCapabilityTestCase{
 
@@ -513,7 +1140,7 @@ func getVolumeCapabilityTestCases() []volumeCapabilityTestCase {
 		},
 		{
 			capabilitySet:     []*csi.VolumeCapability{&mnroCap},
-			isPacketSupported: false,
+			isPacketSupported: true,
 			description:       "multi node read only",
 		},
 		{
@@ -536,6 +1163,21 @@ func getVolumeCapabilityTestCases() []volumeCapabilityTestCase {
 			isPacketSupported: true,
 			description:       "single node capabilities",
 		},
+		{
+			capabilitySet:     []*csi.VolumeCapability{&mnroCap, &snroCap},
+			isPacketSupported: true,
+			description:       "read only capabilities",
+		},
+		{
+			capabilitySet:     []*csi.VolumeCapability{&snwBlockCap, &mnroBlockCap},
+			isPacketSupported: true,
+			description:       "block access",
+		},
+		{
+			capabilitySet:     []*csi.VolumeCapability{&snwMountCap, &snwBlockCap},
+			isPacketSupported: true,
+			description:       "mount and block access",
+		},
 	}
 }
 
@@ -545,7 +1187,7 @@ func TestValidateVolumeCapabilities(t *testing.T) {
 	defer mockCtrl.Finish()
 	provider := test.NewMockVolumeProvider(mockCtrl)
 
-	controller := NewPacketControllerServer(provider)
+	controller := NewPacketControllerServer(provider, Options{})
 
 	for _, testCase := range getVolumeCapabilityTestCases() {
 
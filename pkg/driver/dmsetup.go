@@ -0,0 +1,159 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dmsetupUUIDPrefix marks the maps as the driver's, unlike the mpath- prefix of multipath itself,
+// so that a multipathd running on the host does not adopt and reload them
+const dmsetupUUIDPrefix = "csi-packet-"
+
+// multipathDmsetup builds the multipath table from the iscsi disks with the wwid and loads it with dmsetup,
+// so that neither the host multipath configuration nor multipathd is involved
+type multipathDmsetup struct {
+	host nodeHost
+}
+
+// sysfsBlock holds the attributes of each disk
+var sysfsBlock = "/sys/class/block/"
+
+// pathDisk is a disk which is a path to a volume
+type pathDisk struct {
+	path    string
+	number  string
+	sectors uint64
+}
+
+// readPathDisk reads the device number and size, in 512 byte sectors, of a disk from sysfs
+func readPathDisk(devicePath string) (pathDisk, error) {
+	dir := filepath.Join(sysfsBlock, filepath.Base(devicePath))
+	number, err := ioutil.ReadFile(filepath.Join(dir, "dev"))
+	if err != nil {
+		return pathDisk{}, err
+	}
+	size, err := ioutil.ReadFile(filepath.Join(dir, "size"))
+	if err != nil {
+		return pathDisk{}, err
+	}
+	sectors, err := strconv.ParseUint(strings.TrimSpace(string(size)), 10, 64)
+	if err != nil {
+		return pathDisk{}, err
+	}
+	return pathDisk{path: devicePath, number: strings.TrimSpace(string(number)), sectors: sectors}, nil
+}
+
+// multipathTable returns the device mapper table of a multipath map over the disks, in one round-robin group;
+// without queue_if_no_path, i/o fails once no path is left rather than hanging
+func multipathTable(disks []pathDisk) (string, error) {
+	if len(disks) == 0 {
+		return "", fmt.Errorf("no paths")
+	}
+	sectors := disks[0].sectors
+	paths := []string{}
+	for _, disk := range disks {
+		if disk.sectors != sectors {
+			return "", fmt.Errorf("path %s has %d sectors, %s has %d", disk.path, disk.sectors, disks[0].path, sectors)
+		}
+		paths = append(paths, disk.number+" 1")
+	}
+	return fmt.Sprintf("0 %d multipath 0 0 1 1 round-robin 0 %d 1 %s", sectors, len(disks), strings.Join(paths, " ")), nil
+}
+
+// matchPaths returns the iscsi disks whose scsi id is the wwid, devicePath being one of them
+func (h nodeHost) matchPaths(wwid, devicePath string) ([]pathDisk, error) {
+	links, err := filepath.Glob(filepath.Join(h.layout.diskByPath, "*-iscsi-*"))
+	if err != nil {
+		return nil, err
+	}
+	candidates := map[string]bool{devicePath: true}
+	for _, link := range links {
+		if disk, err := filepath.EvalSymlinks(link); err == nil {
+			candidates[disk] = true
+		}
+	}
+
+	disks := []pathDisk{}
+	for candidate := range candidates {
+		scsiID, err := h.getScsiID(candidate)
+		if err != nil || scsiID != wwid {
+			continue
+		}
+		disk, err := readPathDisk(candidate)
+		if err != nil {
+			return nil, err
+		}
+		disks = append(disks, disk)
+	}
+	sort.Slice(disks, func(i, j int) bool { return disks[i].path < disks[j].path })
+	return disks, nil
+}
+
+// dmsetupUUID returns the uuid of the map, or empty if there is no map of the name; any other
+// failure, such as a timeout, is an error, since the map may well exist
+func (h nodeHost) dmsetupUUID(ctx context.Context, name string) (string, error) {
+	out, err := runCommand(h.exec.command(ctx, "dmsetup", "info", "--noheadings", "--columns", "--options", "uuid", name))
+	if err != nil {
+		if ctx.Err() == nil && strings.Contains(string(out), "Device does not exist") {
+			return "", nil
+		}
+		return "", fmt.Errorf("dmsetup info %s, %v: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Create loads a map of every disk with the wwid under the alias, a map of the alias and wwid is left as it is
+func (m *multipathDmsetup) Create(ctx context.Context, alias, wwid, devicePath string) error {
+	uuid := dmsetupUUIDPrefix + wwid
+	existing, err := m.host.dmsetupUUID(ctx, alias)
+	if err != nil {
+		return err
+	}
+	switch existing {
+	case "":
+	case uuid:
+		return nil
+	default:
+		return fmt.Errorf("map %s exists with uuid %s, not %s", alias, existing, uuid)
+	}
+
+	// settle so that the disks of every logged in portal are linked
+	m.host.execCommandContext(ctx, "udevadm", "settle")
+	disks, err := m.host.matchPaths(wwid, devicePath)
+	if err != nil {
+		return err
+	}
+	table, err := multipathTable(disks)
+	if err != nil {
+		return fmt.Errorf("map %s, %v", alias, err)
+	}
+	if _, err = m.host.execCommandContext(ctx, "dmsetup", "create", alias, "--uuid", uuid, "--table", table); err != nil {
+		return err
+	}
+	paths := []string{}
+	for _, disk := range disks {
+		paths = append(paths, disk.path)
+	}
+	log.WithFields(log.Fields{"alias": alias, "paths": paths, "table": table}).Info("dmsetup map created")
+	return nil
+}
+
+// Remove removes the map, if there is one
+func (m *multipathDmsetup) Remove(alias, wwid string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), multipathTimeout)
+	defer cancel()
+
+	existing, err := m.host.dmsetupUUID(ctx, alias)
+	if err != nil || existing == "" {
+		return err
+	}
+	_, err = m.host.execCommandContext(ctx, "dmsetup", "remove", "--retry", alias)
+	return err
+}
@@ -2,21 +2,211 @@ package driver
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"time"
 
 	"github.com/packethost/csi-packet/pkg/packet"
 	log "github.com/sirupsen/logrus"
 )
 
+// Node id strategies determine the node id reported by the node plugin
+// and how the controller maps that id back to a packet device
+const (
+	// NodeIDDeviceID reports the device uuid from the metadata service, used by the controller as is
+	NodeIDDeviceID = "device-id"
+	// NodeIDHostname matches the node id against device hostnames
+	NodeIDHostname = "hostname"
+	// NodeIDIP matches the node id against device ip addresses
+	NodeIDIP = "ip"
+)
+
+// DefaultNodeIDStrategies is the strategy order used if none is configured
+var DefaultNodeIDStrategies = []string{NodeIDHostname, NodeIDIP}
+
+// Options holds the driver settings supplied on the command line
+type Options struct {
+	// NodeIDStrategies lists the node id strategies in order of preference
+	NodeIDStrategies []string
+	// MaxVolumesPerNode limits the volumes attached to one node, zero means the packet limit
+	MaxVolumesPerNode int64
+	// ForceDetach permits the controller to detach a volume from a device that is no longer active
+	// so that it may be attached elsewhere
+	ForceDetach bool
+	// StateDir is where the node records the volumes it has staged
+	StateDir string
+	// Reconcile is the mode of the node startup reconciliation, report if empty
+	Reconcile string
+	// Metadata configures the client of the metadata service
+	Metadata packet.MetadataConfig
+	// DeviceWaitTimeout bounds the waits for a volume to appear in the metadata and for its disk to appear
+	DeviceWaitTimeout time.Duration
+	// MinPaths is the number of portals which must be logged in to stage a volume
+	MinPaths int
+	// PortalLoginTimeout bounds the discovery and login at each portal
+	PortalLoginTimeout time.Duration
+	// MultipathBackend creates the multipath maps of staged volumes
+	MultipathBackend string
+	// ExecMode is where the host tools are run, in the container if empty
+	ExecMode string
+	// HostRoot is where the host root filesystem is mounted, for the chroot exec mode
+	HostRoot string
+	// HostLayout names the layout of the host's tools and files, detected if empty or auto
+	HostLayout string
+	// HostPaths are name=path pairs giving the paths of tools not on the default path, or
+	// overriding a path of the host layout
+	HostPaths []string
+}
+
+// DefaultDeviceWaitTimeout is the wait for a newly attached volume, if none is configured
+const DefaultDeviceWaitTimeout = time.Minute
+
+// DefaultPortalLoginTimeout is the login timeout at each portal, if none is configured
+const DefaultPortalLoginTimeout = 30 * time.Second
+
+// minPaths returns the configured number of paths required, at least one
+func (o Options) minPaths() int {
+	if o.MinPaths < 1 {
+		return 1
+	}
+	return o.MinPaths
+}
+
+// portalLoginTimeout returns the configured timeout, or the default
+func (o Options) portalLoginTimeout() time.Duration {
+	if o.PortalLoginTimeout <= 0 {
+		return DefaultPortalLoginTimeout
+	}
+	return o.PortalLoginTimeout
+}
+
+// multipathBackend returns the configured backend, or the multipath tool
+func (o Options) multipathBackend() string {
+	if o.MultipathBackend == "" {
+		return MultipathTool
+	}
+	return o.MultipathBackend
+}
+
+// hostExec returns how the host tools are run; the paths of the tools in the host layout are
+// the layout's, so that they are configured in one place
+func (o Options) hostExec() (hostExecConfig, error) {
+	paths, err := parseHostPaths(o.HostPaths)
+	if err != nil {
+		return hostExecConfig{}, err
+	}
+	tools := map[string]string{}
+	for name, path := range paths {
+		if !layoutPaths[name] {
+			tools[name] = path
+		}
+	}
+	config := hostExecConfig{mode: o.ExecMode, hostRoot: o.HostRoot, tools: tools}
+	if config.mode == "" {
+		config.mode = ExecContainer
+	}
+	if config.hostRoot == "" {
+		config.hostRoot = DefaultHostRoot
+	}
+	return config, nil
+}
+
+// nodeHost returns how the host tools are run and the layout of the host, with the configured host paths
+func (o Options) nodeHost() (nodeHost, error) {
+	exec, err := o.hostExec()
+	if err != nil {
+		return nodeHost{}, err
+	}
+	paths, err := parseHostPaths(o.HostPaths)
+	if err != nil {
+		return nodeHost{}, err
+	}
+	layout, err := newHostLayout(o.HostLayout, paths, exec)
+	if err != nil {
+		return nodeHost{}, err
+	}
+	return nodeHost{exec: exec, layout: layout}, nil
+}
+
+// reconcile returns the configured reconcile mode, or report
+func (o Options) reconcile() string {
+	if o.Reconcile == "" {
+		return ReconcileReport
+	}
+	return o.Reconcile
+}
+
+// deviceWaitTimeout returns the configured wait, or the default
+func (o Options) deviceWaitTimeout() time.Duration {
+	if o.DeviceWaitTimeout <= 0 {
+		return DefaultDeviceWaitTimeout
+	}
+	return o.DeviceWaitTimeout
+}
+
+// maxVolumesPerNode returns the configured limit, or the packet per-device limit
+func (o Options) maxVolumesPerNode() int64 {
+	if o.MaxVolumesPerNode <= 0 {
+		return packet.MaxVolumesPerDevice
+	}
+	return o.MaxVolumesPerNode
+}
+
+// nodeIDStrategies returns the configured strategies, or the defaults
+func (o Options) nodeIDStrategies() []string {
+	if len(o.NodeIDStrategies) == 0 {
+		return DefaultNodeIDStrategies
+	}
+	return o.NodeIDStrategies
+}
+
+func (o Options) validate() error {
+	for _, strategy := range o.NodeIDStrategies {
+		switch strategy {
+		case NodeIDDeviceID, NodeIDHostname, NodeIDIP:
+		default:
+			return fmt.Errorf("unknown node id strategy %s", strategy)
+		}
+	}
+	switch o.Reconcile {
+	case "", ReconcileEnabled, ReconcileReport, ReconcileDisabled:
+	default:
+		return fmt.Errorf("unknown reconcile mode %s", o.Reconcile)
+	}
+	if _, err := newMultipathBackend(o.MultipathBackend, nodeHost{}); err != nil {
+		return err
+	}
+	switch o.ExecMode {
+	case "", ExecContainer, ExecNsenter, ExecChroot:
+	default:
+		return fmt.Errorf("unknown exec mode %s", o.ExecMode)
+	}
+	if o.MaxVolumesPerNode > packet.MaxVolumesPerDevice {
+		return fmt.Errorf("max volumes per node %d exceeds the packet limit of %d", o.MaxVolumesPerNode, packet.MaxVolumesPerDevice)
+	}
+	return nil
+}
+
 type PacketDriver struct {
 	name     string
 	nodeID   string
 	endpoint string
 	config   packet.Config
+	options  Options
+	metadata packet.MetadataClient
+	host     nodeHost
 	Logger   *log.Entry
 }
 
-func NewPacketDriver(endpoint, nodeID, configurationPath string) (*PacketDriver, error) {
+func NewPacketDriver(endpoint, nodeID, configurationPath string, options Options) (*PacketDriver, error) {
+
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	host, err := options.nodeHost()
+	if err != nil {
+		return nil, err
+	}
 
 	var config packet.Config
 	if configurationPath != "" {
@@ -36,6 +226,9 @@ func NewPacketDriver(endpoint, nodeID, configurationPath string) (*PacketDriver,
 		nodeID:   nodeID,
 		endpoint: endpoint,
 		config:   config,
+		options:  options,
+		metadata: packet.NewMetadataClient(options.Metadata),
+		host:     host,
 		Logger:   log.WithFields(log.Fields{"node": nodeID, "endpoint": endpoint}),
 	}, nil
 }
@@ -46,14 +239,20 @@ func (d *PacketDriver) Run() {
 	identity := NewPacketIdentityServer(d)
 	var controller *PacketControllerServer
 	if d.config.AuthToken != "" {
-		p, err := packet.NewPacketProvider(d.config)
+		p, err := packet.NewPacketProvider(d.config, d.metadata)
 		if err != nil {
 			d.Logger.Fatalf("Unable to create controller %+v", err)
 		}
-		controller = NewPacketControllerServer(p)
+		controller = NewPacketControllerServer(p, d.options)
+	}
+	node := NewPacketNodeServer(d, NewISCSIAdm(d), NewMounter(d), NewBlockDeviceProber(d))
+	// the controller does not stage volumes, so has nothing to reconcile
+	if controller == nil && d.options.reconcile() != ReconcileDisabled {
+		if err := node.reconcile(d.options.reconcile() == ReconcileReport); err != nil {
+			d.Logger.Errorf("reconcile error, %v", err)
+		}
 	}
-	node := NewPacketNodeServer(d)
-	d.Logger.Info("Starting server")
+	d.Logger.WithFields(log.Fields{"host_layout": d.host.layout.name, "exec_mode": d.host.exec.mode}).Info("Starting server")
 	s.Start(d.endpoint,
 		identity,
 		controller,
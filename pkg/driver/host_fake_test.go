@@ -0,0 +1,96 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHost keeps the node helpers off the host: commands are recorded rather than run, and the
+// disk links, sysfs and multipath bindings are under a temporary directory. Its nodeHost runs the
+// helpers on the fake, as does that of a driver it is installed in
+type fakeHost struct {
+	nodeHost
+	dir      string
+	mutex    sync.Mutex
+	commands []string
+	// run answers a command, joined with spaces; without it every command succeeds with no output
+	run func(command string) ([]byte, error)
+
+	saved struct {
+		runCommand             func(*exec.Cmd) ([]byte, error)
+		sysfsBlock             string
+		devicePollInterval     time.Duration
+		multipathdPollInterval time.Duration
+	}
+}
+
+// newFakeHost saves the globals which reach the host and points them, and its nodeHost, at the fake, until restore
+func newFakeHost(t *testing.T) *fakeHost {
+	dir, err := ioutil.TempDir("", "csi-packet-host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &fakeHost{dir: dir}
+	h.saved.runCommand = runCommand
+	h.saved.sysfsBlock = sysfsBlock
+	h.saved.devicePollInterval, h.saved.multipathdPollInterval = devicePollInterval, multipathdPollInterval
+
+	h.exec = hostExecConfig{mode: ExecContainer}
+	h.layout = hostLayouts[HostLayoutClassic]
+	h.fake(&h.layout)
+	runCommand = h.runCommand
+	sysfsBlock = filepath.Join(dir, "sys")
+	devicePollInterval, multipathdPollInterval = time.Millisecond, time.Millisecond
+	for _, path := range []string{h.layout.diskByPath, sysfsBlock} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return h
+}
+
+// fake points the paths of the layout at the fake's files
+func (h *fakeHost) fake(layout *hostLayout) {
+	layout.multipathExec = filepath.Join(h.dir, "sbin", "multipath")
+	layout.multipathBindings = filepath.Join(h.dir, "bindings")
+	layout.diskByPath = filepath.Join(h.dir, "by-path")
+}
+
+// install points the host of the driver, as its options chose it, at the fake's files and takes it as the fake's own
+func (h *fakeHost) install(driver *PacketDriver) {
+	h.fake(&driver.host.layout)
+	h.nodeHost = driver.host
+}
+
+func (h *fakeHost) runCommand(cmd *exec.Cmd) ([]byte, error) {
+	command := strings.Join(cmd.Args, " ")
+	h.mutex.Lock()
+	h.commands = append(h.commands, command)
+	run := h.run
+	h.mutex.Unlock()
+	if run == nil {
+		return []byte{}, nil
+	}
+	return run(command)
+}
+
+// ran returns the commands run so far
+func (h *fakeHost) ran() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]string{}, h.commands...)
+}
+
+// restore puts back the globals and removes the directory
+func (h *fakeHost) restore() {
+	runCommand = h.saved.runCommand
+	sysfsBlock = h.saved.sysfsBlock
+	devicePollInterval, multipathdPollInterval = h.saved.devicePollInterval, h.saved.multipathdPollInterval
+	os.RemoveAll(h.dir)
+}
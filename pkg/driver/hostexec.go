@@ -0,0 +1,101 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Exec modes determine where the node finds the tools it runs, such as iscsiadm, multipath and mkfs
+const (
+	// ExecContainer runs the tools of the plugin image
+	ExecContainer = "container"
+	// ExecNsenter runs the host's tools in the mount namespace of the host's init process, which needs hostPID
+	ExecNsenter = "nsenter"
+	// ExecChroot runs the host's tools chrooted to the host root, mounted into the plugin at HostRoot
+	ExecChroot = "chroot"
+)
+
+// DefaultHostRoot is where the host root filesystem is mounted for the chroot exec mode
+const DefaultHostRoot = "/host"
+
+// hostExecConfig is how tools are run
+type hostExecConfig struct {
+	mode     string
+	hostRoot string
+	// tools maps the name of a tool to its path, for those not on the default path and not in the host layout
+	tools map[string]string
+}
+
+// nodeHost is how the node helpers run the host's tools and where they find its files, from the
+// options of the driver
+type nodeHost struct {
+	exec   hostExecConfig
+	layout hostLayout
+}
+
+// pluginTools always run in the plugin, whatever the exec mode, since they act on the staging and
+// target paths which the plugin checks in its own mount table; the host's mounts reach the plugin
+// only through the propagation of the kubelet directory
+var pluginTools = map[string]bool{
+	"mount":  true,
+	"umount": true,
+}
+
+// runCommand runs a command and returns its combined output, a variable so that tests may record commands
+var runCommand = func(cmd *exec.Cmd) ([]byte, error) {
+	return cmd.CombinedOutput()
+}
+
+// parseHostPaths reads name=path pairs, such as scsi_id=/usr/lib/udev/scsi_id or
+// multipath-bindings=/var/lib/multipath/bindings
+func parseHostPaths(pairs []string) (map[string]string, error) {
+	paths := map[string]string{}
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+		if i < 1 || i == len(pair)-1 {
+			return nil, fmt.Errorf("host path %s is not of the form name=path", pair)
+		}
+		paths[pair[:i]] = pair[i+1:]
+	}
+	return paths, nil
+}
+
+// toolPath returns the configured path of the command, keyed by its name, or the command itself
+func (c hostExecConfig) toolPath(command string) string {
+	if path, ok := c.tools[filepath.Base(command)]; ok {
+		return path
+	}
+	return command
+}
+
+// command returns the command to run the tool with the arguments, in the host if so configured
+func (c hostExecConfig) command(ctx context.Context, command string, args ...string) *exec.Cmd {
+	if pluginTools[filepath.Base(command)] {
+		return exec.CommandContext(ctx, c.toolPath(command), args...)
+	}
+	command = c.toolPath(command)
+	switch c.mode {
+	case ExecNsenter:
+		nsenterArgs := append([]string{"--target", "1", "--mount", "--", command}, args...)
+		return exec.CommandContext(ctx, c.toolPath("nsenter"), nsenterArgs...)
+	case ExecChroot:
+		chrootArgs := append([]string{c.hostRoot, command}, args...)
+		return exec.CommandContext(ctx, c.toolPath("chroot"), chrootArgs...)
+	}
+	return exec.CommandContext(ctx, command, args...)
+}
+
+// hostPath returns where a path of the host is found from within the plugin, for the files which
+// the plugin shares with the host tools, such as the multipath bindings
+func (c hostExecConfig) hostPath(path string) string {
+	switch c.mode {
+	case ExecNsenter:
+		return filepath.Join("/proc/1/root", path)
+	case ExecChroot:
+		return filepath.Join(c.hostRoot, path)
+	}
+	return path
+}
@@ -0,0 +1,151 @@
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Host layouts name where the host keeps the tools and files the node uses
+const (
+	// HostLayoutAuto detects the layout from the host's os-release
+	HostLayoutAuto = "auto"
+	// HostLayoutClassic has the tools in /sbin and /lib, as on older debian and ubuntu
+	HostLayoutClassic = "classic"
+	// HostLayoutUsrMerged has the tools in /usr/sbin and /usr/lib, as on flatcar, ubuntu 22 and debian 12 and later and rhel
+	HostLayoutUsrMerged = "usr-merged"
+)
+
+// hostLayout holds the paths of the host tools and files used by the node helpers
+type hostLayout struct {
+	name              string
+	multipathExec     string
+	multipathBindings string
+	scsiID            string
+	diskByPath        string
+}
+
+// hostLayouts are the layouts which may be selected by name
+var hostLayouts = map[string]hostLayout{
+	HostLayoutClassic: {
+		name:              HostLayoutClassic,
+		multipathExec:     "/sbin/multipath",
+		multipathBindings: "/etc/multipath/bindings",
+		scsiID:            "/lib/udev/scsi_id",
+		diskByPath:        "/dev/disk/by-path/",
+	},
+	HostLayoutUsrMerged: {
+		name:              HostLayoutUsrMerged,
+		multipathExec:     "/usr/sbin/multipath",
+		multipathBindings: "/etc/multipath/bindings",
+		scsiID:            "/usr/lib/udev/scsi_id",
+		diskByPath:        "/dev/disk/by-path/",
+	},
+}
+
+// osReleaseLayouts maps the os-release ID of a host to its layout
+var osReleaseLayouts = map[string]string{
+	"flatcar":   HostLayoutUsrMerged,
+	"coreos":    HostLayoutUsrMerged,
+	"rhel":      HostLayoutUsrMerged,
+	"centos":    HostLayoutUsrMerged,
+	"rocky":     HostLayoutUsrMerged,
+	"almalinux": HostLayoutUsrMerged,
+	"fedora":    HostLayoutUsrMerged,
+}
+
+// osReleaseUsrMerged maps the os-release ID of a host whose layout changed to the first major version with the /usr paths
+var osReleaseUsrMerged = map[string]int{
+	"ubuntu": 22,
+	"debian": 12,
+}
+
+// layoutPaths are the names of the host paths which are part of the layout, rather than tools run from the default path
+var layoutPaths = map[string]bool{
+	"multipath":          true,
+	"multipath-bindings": true,
+	"scsi_id":            true,
+	"disk-by-path":       true,
+}
+
+// parseOSRelease returns the ID and major VERSION_ID of an os-release file
+func parseOSRelease(data []byte) (string, int) {
+	id, version := "", 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, "=")
+		if i < 0 {
+			continue
+		}
+		value := strings.Trim(line[i+1:], `"'`)
+		switch line[:i] {
+		case "ID":
+			id = value
+		case "VERSION_ID":
+			fmt.Sscanf(value, "%d", &version)
+		}
+	}
+	return id, version
+}
+
+// osReleaseLayout returns the layout for an os-release ID and version; ubuntu moved to the /usr paths
+// with 22.04 and debian with 12
+func osReleaseLayout(id string, version int) (string, bool) {
+	if merged, ok := osReleaseUsrMerged[id]; ok {
+		if version >= merged {
+			return HostLayoutUsrMerged, true
+		}
+		return HostLayoutClassic, true
+	}
+	name, ok := osReleaseLayouts[id]
+	return name, ok
+}
+
+// detectHostLayout chooses the layout from the host's os-release, or else by where scsi_id is found,
+// reading the host's files as the exec config reaches them
+func detectHostLayout(exec hostExecConfig) string {
+	if data, err := ioutil.ReadFile(exec.hostPath("/etc/os-release")); err == nil {
+		if name, ok := osReleaseLayout(parseOSRelease(data)); ok {
+			return name
+		}
+	}
+	if _, err := os.Stat(exec.hostPath(hostLayouts[HostLayoutClassic].scsiID)); err != nil {
+		return HostLayoutUsrMerged
+	}
+	return HostLayoutClassic
+}
+
+// newHostLayout returns the layout of the name, detected if it is auto or empty, with those of the
+// host paths which are part of the layout in place of its own
+func newHostLayout(name string, paths map[string]string, exec hostExecConfig) (hostLayout, error) {
+	if name == "" || name == HostLayoutAuto {
+		name = detectHostLayout(exec)
+	}
+	selected, ok := hostLayouts[name]
+	if !ok {
+		names := []string{}
+		for known := range hostLayouts {
+			names = append(names, known)
+		}
+		sort.Strings(names)
+		return hostLayout{}, fmt.Errorf("unknown host layout %s, expected auto or one of %v", name, names)
+	}
+	for key, path := range paths {
+		switch key {
+		case "multipath":
+			selected.multipathExec = path
+		case "multipath-bindings":
+			selected.multipathBindings = path
+		case "scsi_id":
+			selected.scsiID = path
+		case "disk-by-path":
+			selected.diskByPath = path
+		}
+	}
+	return selected, nil
+}
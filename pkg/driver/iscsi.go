@@ -0,0 +1,128 @@
+package driver
+
+import (
+	"context"
+	"regexp"
+	"strings"
+)
+
+// ISCSITarget is a portal and target name, as listed for an iscsi session or node record
+type ISCSITarget struct {
+	Portal string
+	IQN    string
+}
+
+// ISCSI manages the iscsi sessions of the node
+type ISCSI interface {
+	// Discover finds the targets at a portal, creating their node records
+	Discover(ctx context.Context, portal string) error
+	// Login starts a session, if there is none
+	Login(ctx context.Context, portal, iqn string) error
+	// Logout ends a session, if there is one
+	Logout(portal, iqn string) error
+	// Sessions lists the active sessions
+	Sessions() ([]ISCSITarget, error)
+	// NodeRecords lists the node records left by discovery
+	NodeRecords() ([]ISCSITarget, error)
+	// Rescan looks for new disks in a session
+	Rescan(portal, iqn string) error
+	// DeleteNode deletes a node record
+	DeleteNode(portal, iqn string) error
+}
+
+// iscsiadm implements ISCSI with the open-iscsi client
+type iscsiadm struct {
+	host nodeHost
+}
+
+var _ ISCSI = &iscsiadm{}
+
+// NewISCSIAdm returns the ISCSI implementation which runs iscsiadm on the driver's host
+func NewISCSIAdm(driver *PacketDriver) ISCSI {
+	return &iscsiadm{host: driver.host}
+}
+
+func (i *iscsiadm) Discover(ctx context.Context, portal string) error {
+	// iscsiadm --mode discovery --type sendtargets --portal 10.144.144.226 --discover
+	args := []string{"--mode", "discovery", "--portal", portal, "--type", "sendtargets", "--discover"}
+	_, err := i.host.execCommandContext(ctx, "iscsiadm", args...)
+	return err
+}
+
+func (i *iscsiadm) Login(ctx context.Context, portal, iqn string) error {
+	if hasSession(i, portal, iqn) {
+		return nil
+	}
+	args := []string{"--mode", "node", "--portal", portal, "--targetname", iqn, "--login"}
+	_, err := i.host.execCommandContext(ctx, "iscsiadm", args...)
+	return err
+}
+
+func (i *iscsiadm) Logout(portal, iqn string) error {
+	if !hasSession(i, portal, iqn) {
+		return nil
+	}
+	args := []string{"--mode", "node", "--portal", portal, "--targetname", iqn, "--logout"}
+	_, err := i.host.execCommand("iscsiadm", args...)
+	return err
+}
+
+// Sessions may log an extraneous error if there are none, since iscsiadm then fails
+func (i *iscsiadm) Sessions() ([]ISCSITarget, error) {
+	out, err := i.host.execCommand("iscsiadm", "--mode", "session")
+	if err != nil {
+		return []ISCSITarget{}, nil // this is almost certainly "No active sessions"
+	}
+	return parseIscsiTargets(string(out)), nil
+}
+
+// NodeRecords may log an extraneous error if there are none, since iscsiadm then fails
+func (i *iscsiadm) NodeRecords() ([]ISCSITarget, error) {
+	out, err := i.host.execCommand("iscsiadm", "--mode", "node")
+	if err != nil {
+		return []ISCSITarget{}, nil // this is almost certainly "No records found"
+	}
+	return parseIscsiTargets(string(out)), nil
+}
+
+func (i *iscsiadm) Rescan(portal, iqn string) error {
+	args := []string{"--mode", "node", "--portal", portal, "--targetname", iqn, "--rescan"}
+	_, err := i.host.execCommand("iscsiadm", args...)
+	return err
+}
+
+func (i *iscsiadm) DeleteNode(portal, iqn string) error {
+	args := []string{"--mode", "node", "--portal", portal, "--targetname", iqn, "--op", "delete"}
+	_, err := i.host.execCommand("iscsiadm", args...)
+	return err
+}
+
+// hasSession checks to see if the session exists
+func hasSession(iscsi ISCSI, portal, iqn string) bool {
+	sessions, err := iscsi.Sessions()
+	if err != nil {
+		return false
+	}
+	for _, session := range sessions {
+		if session.Portal == portal && session.IQN == iqn {
+			return true
+		}
+	}
+	return false
+}
+
+// matches the "10.144.144.226:3260,1 iqn..." of both iscsiadm session and node listings
+var iscsiTargetPattern = regexp.MustCompile(`(\d+\.\d+\.\d+\.\d+):\d+,\d+\s+(\S+)`)
+
+// parseIscsiTargets reads the output of iscsiadm --mode session or iscsiadm --mode node
+func parseIscsiTargets(out string) []ISCSITarget {
+	targets := []ISCSITarget{}
+	for _, line := range strings.Split(out, "\n") {
+		match := iscsiTargetPattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		targets = append(targets, ISCSITarget{Portal: match[1], IQN: match[2]})
+	}
+	return targets
+}
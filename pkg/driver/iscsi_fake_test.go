@@ -0,0 +1,107 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// fakeISCSI keeps sessions and node records in memory; discovery fails at unreachable portals and
+// login at hanging portals waits until it is cancelled
+type fakeISCSI struct {
+	mutex       sync.Mutex
+	sessions    map[ISCSITarget]bool
+	records     map[ISCSITarget]bool
+	unreachable map[string]bool
+	hanging     map[string]bool
+	targets     map[string][]string
+	rescans     []ISCSITarget
+}
+
+var _ ISCSI = &fakeISCSI{}
+
+// newFakeISCSI returns a fake at which the portals offer the target
+func newFakeISCSI(iqn string, portals ...string) *fakeISCSI {
+	f := &fakeISCSI{
+		sessions:    map[ISCSITarget]bool{},
+		records:     map[ISCSITarget]bool{},
+		unreachable: map[string]bool{},
+		hanging:     map[string]bool{},
+		targets:     map[string][]string{},
+	}
+	for _, portal := range portals {
+		f.targets[portal] = append(f.targets[portal], iqn)
+	}
+	return f
+}
+
+func (f *fakeISCSI) Discover(ctx context.Context, portal string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.unreachable[portal] {
+		return fmt.Errorf("cannot connect to %s", portal)
+	}
+	for _, iqn := range f.targets[portal] {
+		f.records[ISCSITarget{Portal: portal, IQN: iqn}] = true
+	}
+	return nil
+}
+
+func (f *fakeISCSI) Login(ctx context.Context, portal, iqn string) error {
+	f.mutex.Lock()
+	hanging := f.hanging[portal]
+	f.mutex.Unlock()
+	if hanging {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	target := ISCSITarget{Portal: portal, IQN: iqn}
+	if !f.records[target] {
+		return fmt.Errorf("no record for %s at %s", iqn, portal)
+	}
+	f.sessions[target] = true
+	return nil
+}
+
+func (f *fakeISCSI) Logout(portal, iqn string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.sessions, ISCSITarget{Portal: portal, IQN: iqn})
+	return nil
+}
+
+func (f *fakeISCSI) Sessions() ([]ISCSITarget, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	sessions := []ISCSITarget{}
+	for target := range f.sessions {
+		sessions = append(sessions, target)
+	}
+	return sessions, nil
+}
+
+func (f *fakeISCSI) NodeRecords() ([]ISCSITarget, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	records := []ISCSITarget{}
+	for target := range f.records {
+		records = append(records, target)
+	}
+	return records, nil
+}
+
+func (f *fakeISCSI) Rescan(portal, iqn string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.rescans = append(f.rescans, ISCSITarget{Portal: portal, IQN: iqn})
+	return nil
+}
+
+func (f *fakeISCSI) DeleteNode(portal, iqn string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.records, ISCSITarget{Portal: portal, IQN: iqn})
+	return nil
+}
@@ -1,17 +1,235 @@
 package driver
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
 // Methods to format and mount
 
-func bindmountFs(src, target string) error {
+// allowedMountFlags are the flags which may be given as storage class mount options,
+// mapped to whether they take a value; anything else is refused
+var allowedMountFlags = map[string]bool{
+	"ro":            false,
+	"atime":         false,
+	"noatime":       false,
+	"diratime":      false,
+	"nodiratime":    false,
+	"relatime":      false,
+	"norelatime":    false,
+	"strictatime":   false,
+	"nostrictatime": false,
+	"lazytime":      false,
+	"nolazytime":    false,
+	"discard":       false,
+	"nodiscard":     false,
+	"barrier":       false,
+	"nobarrier":     false,
+	"nodev":         false,
+	"nosuid":        false,
+	"noexec":        false,
+	"sync":          false,
+	"async":         false,
+	"dirsync":       false,
+	"acl":           false,
+	"noacl":         false,
+	"user_xattr":    false,
+	"nouser_xattr":  false,
+	"inode64":       false,
+	"context":       true,
+	"fscontext":     true,
+	"defcontext":    true,
+	"rootcontext":   true,
+	"data":          true,
+	"commit":        true,
+	"errors":        true,
+	"logbufs":       true,
+	"logbsize":      true,
+	"allocsize":     true,
+	"compress":      true,
+	"stripe":        true,
+	"stride":        true,
+}
+
+// mountFlagValue admits plain values; since the flags are joined with commas a value may not hold one,
+// which would pass another flag
+var mountFlagValue = regexp.MustCompile(`^[\w:.-]+$`)
+
+// contextFlagValue admits quoted selinux contexts such as "system_u:object_r:container_file_t:s0:c1,c2",
+// within which mount does not split on the commas of the categories
+var contextFlagValue = regexp.MustCompile(`^"[\w:.,-]+"$`)
+
+// contextMountFlags are the selinux flags, whose values may be quoted
+var contextMountFlags = map[string]bool{
+	"context":     true,
+	"fscontext":   true,
+	"defcontext":  true,
+	"rootcontext": true,
+}
+
+// validateMountFlags refuses unknown flags, and those which would weaken the isolation of the mount
+func validateMountFlags(flags []string) error {
+	for _, flag := range flags {
+		name, value := flag, ""
+		hasValue := false
+		if i := strings.Index(flag, "="); i >= 0 {
+			name, value, hasValue = flag[:i], flag[i+1:], true
+		}
+		takesValue, ok := allowedMountFlags[name]
+		if !ok {
+			return fmt.Errorf("mount flag %s not supported", flag)
+		}
+		validValue := mountFlagValue.MatchString(value) || (contextMountFlags[name] && contextFlagValue.MatchString(value))
+		if hasValue != takesValue || (hasValue && !validValue) {
+			return fmt.Errorf("mount flag %s is malformed", flag)
+		}
+	}
+	return nil
+}
+
+// Mounter mounts, unmounts and formats filesystems
+type Mounter interface {
+	// Mount mounts the filesystem on the source device at the target directory
+	Mount(source, target, fsType string, options []string) error
+	// BindMount bind mounts the source, a directory or a device, at the target
+	BindMount(source, target string, readOnly bool) error
+	Unmount(target string) error
+	// Mounts lists the mount table
+	Mounts() ([]MountInfo, error)
+	// Format creates the filesystem on the device, passing any extra mkfs options
+	Format(devicePath, fsType string, options []string) error
+}
+
+// BlockDeviceProber inspects block devices
+type BlockDeviceProber interface {
+	// GetBlockInfo returns the filesystem signature of a device, os.ErrNotExist if there is no device
+	GetBlockInfo(devicePath string) (BlockInfo, error)
+	// DeviceNumber returns the major:minor number of a device, as shown in the mount table
+	DeviceNumber(devicePath string) (string, error)
+	// ResolveDevice follows links, such as those in /dev/mapper, to the device node
+	ResolveDevice(devicePath string) (string, error)
+}
+
+// execMounter implements Mounter with mount, umount and mkfs
+type execMounter struct {
+	host nodeHost
+}
+
+var _ Mounter = &execMounter{}
+
+// NewMounter returns the Mounter which runs the mount utilities on the driver's host
+func NewMounter(driver *PacketDriver) Mounter {
+	return &execMounter{host: driver.host}
+}
+
+func (m *execMounter) Mount(source, target, fsType string, options []string) error {
+	args := []string{"-t", fsType}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	args = append(args, "--source", source, "--target", target)
+	_, err := m.host.execCommand("mount", args...)
+	return err
+}
+
+func (m *execMounter) BindMount(source, target string, readOnly bool) error {
+	args := []string{"--bind", source, target}
+	_, err := m.host.execCommand("mount", args...)
+	if err != nil {
+		return err
+	}
+	// a bind mount ignores the ro option, so it must be applied by remounting
+	if readOnly {
+		args := []string{"-o", "remount,bind,ro", target}
+		_, err = m.host.execCommand("mount", args...)
+	}
+	return err
+}
+
+func (m *execMounter) Unmount(target string) error {
+	args := []string{target}
+	_, err := m.host.execCommand("umount", args...)
+	return err
+}
+
+func (m *execMounter) Mounts() ([]MountInfo, error) {
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMountInfo(f)
+}
+
+func (m *execMounter) Format(devicePath, fsType string, options []string) error {
+	command := "mkfs." + fsType
+	_, err := m.host.execCommand(command, mkfsArgs(fsType, devicePath, options)...)
+	return err
+}
+
+// execProber implements BlockDeviceProber with lsblk and stat
+type execProber struct {
+	host nodeHost
+}
+
+var _ BlockDeviceProber = &execProber{}
+
+// NewBlockDeviceProber returns the BlockDeviceProber which runs lsblk on the driver's host
+func NewBlockDeviceProber(driver *PacketDriver) BlockDeviceProber {
+	return &execProber{host: driver.host}
+}
+
+func (p *execProber) GetBlockInfo(devicePath string) (BlockInfo, error) {
+	// lsblk names a disk reached through a link, such as the by-path link of a single path volume,
+	// by its kernel name, and a multipath map by the map's name
+	resolved, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return BlockInfo{}, err
+	}
+
+	// use -J json output so we can parse it into a BlockInfo struct
+	out, err := p.host.execCommand("lsblk", "-J", "-i", "--output", "NAME,FSTYPE,LABEL,UUID,MOUNTPOINT", devicePath)
+	if err != nil {
+		return BlockInfo{}, err
+	}
+	return parseLsblk(out, filepath.Base(devicePath), filepath.Base(resolved))
+}
+
+func (p *execProber) DeviceNumber(devicePath string) (string, error) {
+	finfo, err := os.Stat(devicePath)
+	if err != nil {
+		return "", err
+	}
+	stat, ok := finfo.Sys().(*syscall.Stat_t)
+	if !ok || finfo.Mode()&os.ModeDevice == 0 {
+		return "", fmt.Errorf("%s is not a device", devicePath)
+	}
+	rdev := uint64(stat.Rdev)
+	major := (rdev>>8)&0xfff | (rdev>>32)&^0xfff
+	minor := rdev&0xff | (rdev>>12)&^0xff
+	return fmt.Sprintf("%d:%d", major, minor), nil
+}
+
+func (p *execProber) ResolveDevice(devicePath string) (string, error) {
+	return filepath.EvalSymlinks(devicePath)
+}
+
+// mappedDevicePath is the path of a multipath map
+func mappedDevicePath(device string) string {
+	return filepath.Join("/dev/mapper/", device)
+}
+
+func bindmountFs(mounter Mounter, src, target string, readOnly bool) error {
 
 	if _, err := os.Stat(target); err != nil {
 		if os.IsNotExist(err) {
@@ -26,40 +244,216 @@ func bindmountFs(src, target string) error {
 		log.Errorf("stat %s, %v", target, err)
 		return err
 	}
-	args := []string{"--bind", src, target}
-	_, err = execCommand("mount", args...)
-	return err
+	return mounter.BindMount(src, target, readOnly)
 }
 
-func unmountFs(path string) error {
-	args := []string{path}
-	_, err := execCommand("umount", args...)
-	// if err != nil {
-	// 	execCommand("rmdir", args...)
-	// }
-	return err
+// bindmountDevice bind mounts a staged device onto a file at the target path, for raw block access
+func bindmountDevice(mounter Mounter, devicePath, target string, readOnly bool) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		log.Errorf("mkdir %s, %v", filepath.Dir(target), err)
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, 0660)
+	if err != nil {
+		log.Errorf("create %s, %v", target, err)
+		return err
+	}
+	f.Close()
+	return mounter.BindMount(devicePath, target, readOnly)
 }
 
-func mountMappedDevice(device, target string) error {
-	devicePath := filepath.Join("/dev/mapper/", device)
+const mountInfoPath = "/proc/self/mountinfo"
+
+// MountInfo is an entry of the mount table
+type MountInfo struct {
+	// Device is the major:minor number of the mounted filesystem
+	Device string
+	// Root is the path within the filesystem which forms the root of the mount, as for a bind mount
+	Root       string
+	MountPoint string
+	Options    []string
+	FsType     string
+	Source     string
+}
+
+// readOnly reports whether the mount is read-only
+func (m *MountInfo) readOnly() bool {
+	for _, option := range m.Options {
+		if option == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMountInfo reads the mount table in the format of /proc/self/mountinfo
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parseMountInfo(r io.Reader) ([]MountInfo, error) {
+	mounts := []MountInfo{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i, field := range fields {
+			if field == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator < 6 || len(fields) < separator+3 {
+			continue
+		}
+		mounts = append(mounts, MountInfo{
+			Device:     fields[2],
+			Root:       unescapeMountPath(fields[3]),
+			MountPoint: unescapeMountPath(fields[4]),
+			Options:    strings.Split(fields[5], ","),
+			FsType:     fields[separator+1],
+			Source:     unescapeMountPath(fields[separator+2]),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// getMountInfo returns the topmost mount at path, or nil if path is not a mount point
+func getMountInfo(mounter Mounter, path string) (*MountInfo, error) {
+	mounts, err := mounter.Mounts()
+	if err != nil {
+		return nil, err
+	}
+	target := filepath.Clean(path)
+	var found *MountInfo
+	for i := range mounts {
+		if mounts[i].MountPoint == target {
+			found = &mounts[i]
+		}
+	}
+	return found, nil
+}
+
+// isMounted reports whether path is a mount point, according to the mount table
+func isMounted(mounter Mounter, path string) (bool, error) {
+	info, err := getMountInfo(mounter, path)
+	return info != nil, err
+}
+
+// errMountConflict indicates that a path is already a mount point for something other than the volume
+var errMountConflict = errors.New("mount conflict")
+
+// checkDeviceMount reports whether the staged device is already mounted at target;
+// errMountConflict is returned if something else is mounted there
+func checkDeviceMount(mounter Mounter, prober BlockDeviceProber, devicePath, target string) (bool, error) {
+	info, err := getMountInfo(mounter, target)
+	if err != nil || info == nil {
+		return false, err
+	}
+	number, err := prober.DeviceNumber(devicePath)
+	if os.IsNotExist(err) {
+		return false, errors.Wrapf(errMountConflict, "%s has %s mounted, %s does not exist", target, info.Source, devicePath)
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.Device != number {
+		return false, errors.Wrapf(errMountConflict, "%s has %s mounted, not %s", target, info.Source, devicePath)
+	}
+	return true, nil
+}
+
+// checkBindMount reports whether the staging path is already bind mounted at target, with the
+// requested access; errMountConflict is returned if the existing mount differs
+func checkBindMount(mounter Mounter, src, target string, readOnly bool) (bool, error) {
+	info, err := getMountInfo(mounter, target)
+	if err != nil || info == nil {
+		return false, err
+	}
+	srcInfo, err := getMountInfo(mounter, src)
+	if err != nil {
+		return false, err
+	}
+	if srcInfo == nil || info.Device != srcInfo.Device || info.Root != srcInfo.Root {
+		return false, errors.Wrapf(errMountConflict, "%s is not a bind mount of %s", target, src)
+	}
+	if info.readOnly() != readOnly {
+		return false, errors.Wrapf(errMountConflict, "%s is mounted with read-only %t", target, info.readOnly())
+	}
+	return true, nil
+}
+
+// checkBindmountDevice reports whether the staged device is already bind mounted at target, with the
+// requested access; errMountConflict is returned if the existing mount differs
+func checkBindmountDevice(mounter Mounter, prober BlockDeviceProber, devicePath, target string, readOnly bool) (bool, error) {
+	info, err := getMountInfo(mounter, target)
+	if err != nil || info == nil {
+		return false, err
+	}
+	// the root of a device node bind mount is its path within devtmpfs, such as /dm-0
+	node, err := prober.ResolveDevice(devicePath)
+	if err != nil {
+		return false, err
+	}
+	if filepath.Base(info.Root) != filepath.Base(node) {
+		return false, errors.Wrapf(errMountConflict, "%s is not a bind mount of %s", target, devicePath)
+	}
+	if info.readOnly() != readOnly {
+		return false, errors.Wrapf(errMountConflict, "%s is mounted with read-only %t", target, info.readOnly())
+	}
+	return true, nil
+}
+
+// the mount table escapes whitespace and backslashes in paths as octal
+func unescapeMountPath(path string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(path)
+}
+
+// defaultFsType is used when neither the volume capability nor the storage class names a filesystem
+const defaultFsType = "ext4"
+
+// supportedFsTypes are the filesystems which may be created on a volume
+var supportedFsTypes = map[string]bool{
+	"ext4":  true,
+	"ext3":  true,
+	"xfs":   true,
+	"btrfs": true,
+}
+
+// readOnlyMountOptions mount the filesystem without replaying its journal, which would write to the device
+func readOnlyMountOptions(fsType string) []string {
+	switch fsType {
+	case "ext3", "ext4":
+		return []string{"ro", "noload"}
+	case "xfs":
+		return []string{"ro", "norecovery"}
+	case "btrfs":
+		return []string{"ro", "nologreplay"}
+	}
+	return []string{"ro"}
+}
+
+func mountDevice(mounter Mounter, devicePath, target, fsType string, options []string) error {
 	os.MkdirAll(target, os.ModeDir)
-	args := []string{"-t", "ext4", "--source", devicePath, "--target", target}
-	_, err := execCommand("mount", args...)
-	return err
+	return mounter.Mount(devicePath, target, fsType, options)
 }
 
-// etx4 format
-func formatMappedDevice(device string) error {
-	devicePath := filepath.Join("/dev/mapper/", device)
-	args := []string{"-F", devicePath}
-	fstype := "ext4"
-	command := "mkfs." + fstype
-	_, err := execCommand(command, args...)
-	return err
+// mkfsArgs returns the mkfs.<fsType> arguments, forcing creation over whatever the device contains
+func mkfsArgs(fsType, devicePath string, options []string) []string {
+	force := "-f"
+	if strings.HasPrefix(fsType, "ext") {
+		force = "-F"
+	}
+	args := []string{force}
+	args = append(args, options...)
+	return append(args, devicePath)
+}
+
+// format the staged device with the filesystem, passing any extra mkfs options
+func formatDevice(mounter Mounter, devicePath, fsType string, options []string) error {
+	return mounter.Format(devicePath, fsType, options)
 }
 
 // represents the lsblk info
-type blockInfo struct {
+type BlockInfo struct {
 	Name       string `json:"name"`
 	FsType     string `json:"fstype"`
 	Label      string `json:"label"`
@@ -69,33 +463,23 @@ type blockInfo struct {
 
 // represents the lsblk info
 type deviceset struct {
-	BlockDevices []blockInfo `json:"blockdevices"`
+	BlockDevices []BlockInfo `json:"blockdevices"`
 }
 
-// get info
-
-func getMappedDevice(device string) (blockInfo, error) {
-	devicePath := filepath.Join("/dev/mapper/", device)
-
-	// testing issue: must mock out call to Stat as well as to exec.Command
-	if _, err := os.Stat(devicePath); os.IsNotExist(err) {
-		return blockInfo{}, err
-	}
-
-	// use -J json output so we can parse it into a blockInfo struct
-	out, err := execCommand("lsblk", "-J", "-i", "--output", "NAME,FSTYPE,LABEL,UUID,MOUNTPOINT", devicePath)
-	if err != nil {
-		return blockInfo{}, err
-	}
+// parseLsblk selects the named device from lsblk json output
+// parseLsblk returns the device reported under any of the names
+func parseLsblk(out []byte, names ...string) (BlockInfo, error) {
 	devices := deviceset{}
-	err = json.Unmarshal(out, &devices)
+	err := json.Unmarshal(out, &devices)
 	if err != nil {
-		return blockInfo{}, err
+		return BlockInfo{}, err
 	}
 	for _, info := range devices.BlockDevices {
-		if info.Name == device {
-			return info, nil
+		for _, name := range names {
+			if info.Name == name {
+				return info, nil
+			}
 		}
 	}
-	return blockInfo{}, fmt.Errorf("device %s not found", device)
+	return BlockInfo{}, fmt.Errorf("device %s not found", strings.Join(names, " or "))
 }
@@ -0,0 +1,143 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fakeDevice is a block device known to the fakeMounter
+type fakeDevice struct {
+	number string
+	node   string
+	fsType string
+}
+
+// fakeMounter records the calls made to it and simulates the mount table and the filesystem signatures of devices
+type fakeMounter struct {
+	calls   []string
+	mounts  []MountInfo
+	devices map[string]*fakeDevice
+}
+
+var _ Mounter = &fakeMounter{}
+var _ BlockDeviceProber = &fakeMounter{}
+
+func newFakeMounter() *fakeMounter {
+	return &fakeMounter{devices: map[string]*fakeDevice{}}
+}
+
+// addDevice adds a device at the path, such as /dev/mapper/volume-3ee59355, for the device node, such as /dev/dm-1
+func (f *fakeMounter) addDevice(path, number, node, fsType string) {
+	f.devices[path] = &fakeDevice{number: number, node: node, fsType: fsType}
+}
+
+func (f *fakeMounter) accessOption(options []string) string {
+	for _, option := range options {
+		if option == "ro" {
+			return "ro"
+		}
+	}
+	return "rw"
+}
+
+func (f *fakeMounter) Mount(source, target, fsType string, options []string) error {
+	f.calls = append(f.calls, fmt.Sprintf("mount -t %s -o %s %s %s", fsType, strings.Join(options, ","), source, target))
+	device, ok := f.devices[source]
+	if !ok {
+		return fmt.Errorf("special device %s does not exist", source)
+	}
+	if device.fsType != fsType {
+		return fmt.Errorf("wrong fs type %s on %s", fsType, source)
+	}
+	f.mounts = append(f.mounts, MountInfo{
+		Device:     device.number,
+		Root:       "/",
+		MountPoint: filepath.Clean(target),
+		Options:    []string{f.accessOption(options), "relatime"},
+		FsType:     fsType,
+		Source:     source,
+	})
+	return nil
+}
+
+func (f *fakeMounter) BindMount(source, target string, readOnly bool) error {
+	f.calls = append(f.calls, fmt.Sprintf("mount --bind %s %s ro=%t", source, target, readOnly))
+	access := "rw"
+	if readOnly {
+		access = "ro"
+	}
+	if device, ok := f.devices[source]; ok {
+		f.mounts = append(f.mounts, MountInfo{
+			Device:     "0:6",
+			Root:       "/" + filepath.Base(device.node),
+			MountPoint: filepath.Clean(target),
+			Options:    []string{access, "nosuid"},
+			FsType:     "devtmpfs",
+			Source:     "udev",
+		})
+		return nil
+	}
+	src, err := getMountInfo(f, source)
+	if err != nil {
+		return err
+	}
+	if src == nil {
+		return fmt.Errorf("%s is not a mount point", source)
+	}
+	bind := *src
+	bind.MountPoint = filepath.Clean(target)
+	bind.Options = []string{access, "relatime"}
+	f.mounts = append(f.mounts, bind)
+	return nil
+}
+
+func (f *fakeMounter) Unmount(target string) error {
+	f.calls = append(f.calls, fmt.Sprintf("umount %s", target))
+	for i := len(f.mounts) - 1; i >= 0; i-- {
+		if f.mounts[i].MountPoint == filepath.Clean(target) {
+			f.mounts = append(f.mounts[:i], f.mounts[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: not mounted", target)
+}
+
+func (f *fakeMounter) Mounts() ([]MountInfo, error) {
+	return append([]MountInfo{}, f.mounts...), nil
+}
+
+func (f *fakeMounter) Format(devicePath, fsType string, options []string) error {
+	f.calls = append(f.calls, fmt.Sprintf("mkfs.%s %s", fsType, strings.Join(mkfsArgs(fsType, devicePath, options), " ")))
+	device, ok := f.devices[devicePath]
+	if !ok {
+		return fmt.Errorf("%s does not exist", devicePath)
+	}
+	device.fsType = fsType
+	return nil
+}
+
+func (f *fakeMounter) GetBlockInfo(devicePath string) (BlockInfo, error) {
+	device, ok := f.devices[devicePath]
+	if !ok {
+		return BlockInfo{}, os.ErrNotExist
+	}
+	return BlockInfo{Name: filepath.Base(devicePath), FsType: device.fsType}, nil
+}
+
+func (f *fakeMounter) DeviceNumber(devicePath string) (string, error) {
+	device, ok := f.devices[devicePath]
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	return device.number, nil
+}
+
+func (f *fakeMounter) ResolveDevice(devicePath string) (string, error) {
+	device, ok := f.devices[devicePath]
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	return device.node, nil
+}
@@ -0,0 +1,318 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Multipath backends create the map of a volume's paths, named for the volume
+const (
+	// MultipathTool binds the alias in the bindings file and runs the multipath tool
+	MultipathTool = "multipath"
+	// MultipathDaemon asks multipathd for the map and names it for the volume, checking its paths
+	MultipathDaemon = "multipathd"
+	// MultipathDmsetup builds the map of the paths with the volume's wwid itself and loads it with dmsetup
+	MultipathDmsetup = "dmsetup"
+	// MultipathSinglePath creates no map, the volume is staged on the disk of a single portal
+	MultipathSinglePath = "single-path"
+	// MultipathAuto uses the multipath tool if the host has it, or else a single path
+	MultipathAuto = "auto"
+)
+
+// multipathBackend creates and removes the multipath map of a volume
+type multipathBackend interface {
+	// Create maps the disks with the wwid under the alias, devicePath is one of those disks
+	Create(ctx context.Context, alias, wwid, devicePath string) error
+	// Remove flushes the map of the alias, or of the wwid if it is known, and drops the binding of the alias
+	Remove(alias, wwid string) error
+}
+
+// newMultipathBackend returns the backend of the name on the host, the multipath tool if it is empty
+func newMultipathBackend(name string, host nodeHost) (multipathBackend, error) {
+	switch host.resolveMultipathBackend(name) {
+	case "", MultipathTool:
+		return &multipathTool{host: host}, nil
+	case MultipathDaemon:
+		return &multipathDaemon{host: host}, nil
+	case MultipathDmsetup:
+		return &multipathDmsetup{host: host}, nil
+	case MultipathSinglePath:
+		return &singlePath{}, nil
+	}
+	return nil, fmt.Errorf("unknown multipath backend %s", name)
+}
+
+// resolveMultipathBackend chooses the backend for auto, by whether the host has the multipath tool
+func (h nodeHost) resolveMultipathBackend(name string) string {
+	if name != MultipathAuto {
+		return name
+	}
+	if _, err := os.Stat(h.exec.hostPath(h.exec.toolPath(h.layout.multipathExec))); err != nil {
+		return MultipathSinglePath
+	}
+	return MultipathTool
+}
+
+// singlePath has no map to create or remove, the disk of the session is used directly
+type singlePath struct{}
+
+func (s *singlePath) Create(ctx context.Context, alias, wwid, devicePath string) error {
+	return nil
+}
+
+func (s *singlePath) Remove(alias, wwid string) error {
+	return nil
+}
+
+// bindAlias binds the alias to the wwid, discarding the maps given a default name by multipath,
+// which are returned to be flushed and recreated with the volume name
+func (h nodeHost) bindAlias(alias, wwid string) (map[string]string, error) {
+	var discards map[string]string
+	err := h.modifyBindings(func(table *bindingTable) {
+		_, discards = table.bindings()
+		for mappingName := range discards {
+			table.remove(mappingName)
+		}
+		table.set(alias, wwid)
+	})
+	return discards, err
+}
+
+// unbindAlias drops the binding of the alias and those of maps given a default name, which are returned
+func (h nodeHost) unbindAlias(alias string) (map[string]string, error) {
+	var discards map[string]string
+	err := h.modifyBindings(func(table *bindingTable) {
+		_, discards = table.bindings()
+		for mappingName := range discards {
+			table.remove(mappingName)
+		}
+		table.remove(alias)
+	})
+	return discards, err
+}
+
+// multipathTool runs the multipath tool, which may hang in a container so its timeout is not an error
+type multipathTool struct {
+	host nodeHost
+}
+
+func (m *multipathTool) Create(ctx context.Context, alias, wwid, devicePath string) error {
+	discards, err := m.host.bindAlias(alias, wwid)
+	if err != nil {
+		return err
+	}
+	for mappingName := range discards {
+		m.host.multipath("-f", mappingName)
+	}
+	m.host.multipath(alias)
+
+	check, _ := m.host.multipath("-ll", devicePath)
+	logger := log.WithFields(log.Fields{"device": devicePath, "alias": alias})
+	logger.Infof("multipath check: %s", check)
+	if check == "" {
+		logger.Info("empty multipath check")
+	}
+	return nil
+}
+
+func (m *multipathTool) Remove(alias, wwid string) error {
+	discards, err := m.host.unbindAlias(alias)
+	if err != nil {
+		return err
+	}
+	for mappingName := range discards {
+		m.host.multipath("-f", mappingName)
+	}
+	m.host.multipath("-f", alias)
+	return nil
+}
+
+// multipathdPollInterval is the pause between looks for a map in multipathd
+var multipathdPollInterval = time.Second
+
+// multipathDaemon asks multipathd for maps, and reports their state
+type multipathDaemon struct {
+	host nodeHost
+}
+
+// multipathdMaps is the output of multipathd show maps json
+type multipathdMaps struct {
+	Maps []multipathdMap `json:"maps"`
+}
+
+type multipathdMap struct {
+	Name       string `json:"name"`
+	UUID       string `json:"uuid"`
+	Sysfs      string `json:"sysfs"`
+	DmState    string `json:"dm_st"`
+	PathGroups []struct {
+		Paths []multipathdPath `json:"paths"`
+	} `json:"path_groups"`
+}
+
+type multipathdPath struct {
+	Dev        string `json:"dev"`
+	DmState    string `json:"dm_st"`
+	CheckState string `json:"chk_st"`
+}
+
+// livePaths returns the paths which are active and pass the path checker
+func (m *multipathdMap) livePaths() []string {
+	live := []string{}
+	for _, group := range m.PathGroups {
+		for _, path := range group.Paths {
+			if path.DmState == "active" && path.CheckState == "ready" {
+				live = append(live, path.Dev)
+			}
+		}
+	}
+	return live
+}
+
+// verify checks that the map is of the wwid, active and has a live path
+func (m *multipathdMap) verify(wwid string) error {
+	if m.UUID != wwid {
+		return fmt.Errorf("map %s is of %s, not %s", m.Name, m.UUID, wwid)
+	}
+	if m.DmState != "active" {
+		return fmt.Errorf("map %s is %s", m.Name, m.DmState)
+	}
+	if len(m.livePaths()) == 0 {
+		paths := []string{}
+		for _, group := range m.PathGroups {
+			for _, path := range group.Paths {
+				paths = append(paths, fmt.Sprintf("%s %s/%s", path.Dev, path.DmState, path.CheckState))
+			}
+		}
+		return fmt.Errorf("map %s has no live path, %v", m.Name, paths)
+	}
+	return nil
+}
+
+func parseMultipathdMaps(out []byte) ([]multipathdMap, error) {
+	maps := multipathdMaps{}
+	if err := json.Unmarshal(out, &maps); err != nil {
+		return nil, err
+	}
+	return maps.Maps, nil
+}
+
+// multipathd runs a multipathd command, which reports failure in its output rather than its exit status
+func (h nodeHost) multipathd(ctx context.Context, args ...string) ([]byte, error) {
+	out, err := h.execCommandContext(ctx, "multipathd", args...)
+	if err != nil {
+		return nil, err
+	}
+	if result := strings.TrimSpace(string(out)); strings.HasPrefix(result, "fail") {
+		return nil, fmt.Errorf("multipathd %s, %s", strings.Join(args, " "), result)
+	}
+	return out, nil
+}
+
+// showMaps lists the maps known to multipathd
+func (m *multipathDaemon) showMaps(ctx context.Context) ([]multipathdMap, error) {
+	out, err := m.host.multipathd(ctx, "show", "maps", "json")
+	if err != nil {
+		return nil, err
+	}
+	return parseMultipathdMaps(out)
+}
+
+// findMap returns the map which matches, or nil if there is none
+func (m *multipathDaemon) findMap(ctx context.Context, match func(*multipathdMap) bool) (*multipathdMap, error) {
+	maps, err := m.showMaps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range maps {
+		if match(&maps[i]) {
+			return &maps[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Create has multipathd create the map of the wwid, renames it to the alias if multipathd named it otherwise,
+// and waits for it to have a live path. The bindings file and the maps of other volumes are not touched
+func (m *multipathDaemon) Create(ctx context.Context, alias, wwid, devicePath string) error {
+	// the path may already be known to multipathd, which then refuses to add it
+	m.host.multipathd(ctx, "add", "path", strings.TrimPrefix(devicePath, "/dev/"))
+	if _, err := m.host.multipathd(ctx, "add", "map", wwid); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(multipathdPollInterval)
+	defer ticker.Stop()
+	for {
+		found, err := m.findMap(ctx, func(found *multipathdMap) bool { return found.UUID == wwid })
+		if err == nil && found == nil {
+			err = fmt.Errorf("no map of %s", wwid)
+		}
+		if err == nil && found.Name != alias {
+			err = m.rename(ctx, found, alias)
+			if err == nil {
+				err = fmt.Errorf("map %s renamed to %s", found.Name, alias)
+			}
+		} else if err == nil {
+			err = found.verify(wwid)
+			if err == nil {
+				log.WithFields(log.Fields{"alias": alias, "sysfs": found.Sysfs, "paths": found.livePaths()}).Info("multipathd map ready")
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for multipathd map, %v", err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// rename names the map for the volume with dmsetup; multipathd follows the rename, but its own binding
+// keeps the name it chose, to which a reconfiguration or restart of multipathd may return the map
+func (m *multipathDaemon) rename(ctx context.Context, found *multipathdMap, alias string) error {
+	log.WithFields(log.Fields{"alias": alias, "name": found.Name}).Info("renaming multipathd map")
+	_, err := m.host.execCommandContext(ctx, "dmsetup", "rename", found.Name, alias)
+	return err
+}
+
+// restoreAlias renames the map of the wwid back to the alias, should multipathd have renamed it
+func (m *multipathDaemon) restoreAlias(ctx context.Context, alias, wwid string) error {
+	found, err := m.findMap(ctx, func(found *multipathdMap) bool { return found.UUID == wwid })
+	if err != nil || found == nil || found.Name == alias {
+		return err
+	}
+	return m.rename(ctx, found, alias)
+}
+
+// Remove has multipathd remove the map, found by its wwid when known since multipathd may have renamed it,
+// and checks that it is gone
+func (m *multipathDaemon) Remove(alias, wwid string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), multipathTimeout)
+	defer cancel()
+
+	match := func(found *multipathdMap) bool {
+		return found.Name == alias || (wwid != "" && found.UUID == wwid)
+	}
+	found, err := m.findMap(ctx, match)
+	if err != nil || found == nil {
+		return err
+	}
+	if _, err = m.host.multipathd(ctx, "del", "map", found.Name); err != nil {
+		return err
+	}
+	if found, err = m.findMap(ctx, match); err != nil {
+		return err
+	}
+	if found != nil {
+		return fmt.Errorf("map %s remains after removal", found.Name)
+	}
+	return nil
+}
@@ -1,7 +1,14 @@
 package driver
 
 import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
 	"github.com/packethost/csi-packet/pkg/packet"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
 	"github.com/container-storage-interface/spec/lib/go/csi/v0"
@@ -14,12 +21,24 @@ import (
 var _ csi.NodeServer = &PacketNodeServer{}
 
 type PacketNodeServer struct {
-	Driver *PacketDriver
+	Driver   *PacketDriver
+	state    *stateStore
+	metadata packet.MetadataClient
+	iscsi    ISCSI
+	mounter  Mounter
+	prober   BlockDeviceProber
+	host     nodeHost
 }
 
-func NewPacketNodeServer(driver *PacketDriver) *PacketNodeServer {
+func NewPacketNodeServer(driver *PacketDriver, iscsi ISCSI, mounter Mounter, prober BlockDeviceProber) *PacketNodeServer {
 	return &PacketNodeServer{
-		Driver: driver,
+		Driver:   driver,
+		state:    newStateStore(driver.options.StateDir),
+		metadata: driver.metadata,
+		iscsi:    iscsi,
+		mounter:  mounter,
+		prober:   prober,
+		host:     driver.host,
 	}
 }
 
@@ -34,108 +53,260 @@ func (nodeServer *PacketNodeServer) NodeStageVolume(ctx context.Context, in *csi
 	if volumeName == "" {
 		return nil, status.Error(codes.InvalidArgument, "VolumeName unspecified for NodeStageVolume")
 	}
+	if in.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "VolumeCapability unspecified for NodeStageVolume")
+	}
+	block := in.VolumeCapability.GetBlock()
+	mnt := in.VolumeCapability.GetMount()
+	if block == nil && mnt == nil {
+		return nil, status.Error(codes.InvalidArgument, "VolumeCapability access type unspecified for NodeStageVolume")
+	}
+	if err := validateMountFlags(mnt.GetMountFlags()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
 
-	volumeMetaData, err := packet.GetPacketVolumeMetadata(volumeName)
-	if err != nil {
-		nodeServer.Driver.Logger.Errorf("NodeStageVolume: %v", err)
-		return nil, status.Errorf(codes.Unknown, "metadata error, %s", err.Error())
+	// the filesystem is named by the capability, or else by the storage class
+	fsType := mnt.GetFsType()
+	if fsType == "" {
+		fsType = in.VolumeAttributes[fsTypeParameter]
+	}
+	if fsType != "" && !supportedFsTypes[fsType] {
+		return nil, status.Errorf(codes.InvalidArgument, "fs type %s not supported", fsType)
 	}
+	mkfsOptions := strings.Fields(in.VolumeAttributes[mkfsOptionsParameter])
 
-	if len(volumeMetaData.IPs) == 0 {
-		return nil, status.Errorf(codes.Unknown, "volume %s has no portals", volumeName)
+	// a repeated call finds the volume already staged, mounted at the staging path or, for a block
+	// volume which is not mounted, recorded with its device present
+	devicePath, err := nodeServer.stagedDevicePath(ctx, volumeName)
+	if err != nil {
+		return nil, status.Errorf(codes.Unknown, "staged device error, %v", err)
+	}
+	var staged bool
+	if mnt != nil {
+		staged, err = checkDeviceMount(nodeServer.mounter, nodeServer.prober, devicePath, in.StagingTargetPath)
+		if errors.Cause(err) == errMountConflict {
+			return nil, status.Errorf(codes.AlreadyExists, "%v", err)
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Unknown, "mount table error, %v", err)
+		}
+	} else {
+		record, err := nodeServer.state.load(volumeName)
+		if err != nil {
+			return nil, status.Errorf(codes.Unknown, "state load error, %v", err)
+		}
+		if record != nil {
+			_, err = nodeServer.prober.DeviceNumber(devicePath)
+			staged = err == nil
+		}
+	}
+	if staged {
+		nodeServer.Driver.Logger.WithFields(logrus.Fields{"volume_name": volumeName, "staging_target_path": in.StagingTargetPath}).Info("NodeStageVolume volume already staged")
+		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	if in.GetVolumeCapability() == nil {
-		return nil, status.Error(codes.InvalidArgument, "VolumeCapability unspecified for NodeStageVolume")
+	volumeMetaData, err := nodeServer.waitForVolumeTargets(ctx, volumeName, in.PublishInfo)
+	if err != nil {
+		nodeServer.Driver.Logger.Errorf("NodeStageVolume: %v", err)
+		return nil, err
 	}
-	mnt := in.VolumeCapability.GetMount()
-	// options := mnt.MountFlags
 
-	if mnt.FsType != "" {
-		if mnt.FsType != "ext4" {
-			return nil, status.Errorf(codes.InvalidArgument, "fs type %s not supported", mnt.FsType)
-		}
+	if len(volumeMetaData.IPs) == 0 {
+		return nil, status.Errorf(codes.Unknown, "volume %s has no portals", volumeName)
 	}
 
 	logger := nodeServer.Driver.Logger.WithFields(logrus.Fields{
 		"volume_id":           in.VolumeId,
 		"volume_name":         volumeName,
 		"staging_target_path": in.StagingTargetPath,
-		"fsType":              mnt.FsType,
+		"fsType":              fsType,
+		"block":               block != nil,
 		"method":              "NodeStageVolume",
 	})
 
-	// discover and log in to iscsiadmin
+	portals := []string{}
 	for _, ip := range volumeMetaData.IPs {
-		err = iscsiadminDiscover(ip.String()) // iscsiadm --mode discovery --type sendtargets --portal 10.144.144.226 --discover
-		if err != nil {
-			logger.Infof("isciadmin discover error, %+v", err)
-			return nil, status.Errorf(codes.Unknown, "isciadmin discover error, %+v", err)
-		}
-		err = iscsiadminLogin(ip.String(), volumeMetaData.IQN)
-		if err != nil {
-			logger.Infof("isciadmin login error, %+v", err)
-			return nil, status.Errorf(codes.Unknown, "isciadmin login error, %+v", err)
-		}
+		portals = append(portals, ip.String())
+	}
+
+	// discover and log in to iscsiadmin at every portal, multipath survives the loss of some;
+	// without multipath a single portal is used
+	options := nodeServer.Driver.options
+	mode := nodeServer.host.resolveMultipathBackend(options.multipathBackend())
+	var live []string
+	var failed map[string]error
+	minPaths := options.minPaths()
+	if mode == MultipathSinglePath {
+		live, failed = loginSinglePortal(ctx, nodeServer.iscsi, portals, volumeMetaData.IQN, options.portalLoginTimeout())
+		minPaths = 1
+	} else {
+		live, failed = loginPortals(ctx, nodeServer.iscsi, portals, volumeMetaData.IQN, options.portalLoginTimeout())
+	}
+	minPaths = requiredPaths(logger, minPaths, portals)
+	if len(live) < minPaths {
+		logger.WithFields(logrus.Fields{"live": live, "failed": failed}).Info("isciadmin login error")
+		return nil, status.Errorf(codes.Unavailable, "isciadmin login error, %d of %d paths up, %d required, %v", len(live), len(portals), minPaths, failed)
+	}
+	for portal, err := range failed {
+		logger.WithFields(logrus.Fields{"ip": portal, "error": err}).Warn("path degraded")
 	}
 
 	// configure multimap
-	devicePath, err := getDevice(volumeMetaData.IPs[0].String(), volumeMetaData.IQN)
+	deviceCtx, cancel := context.WithTimeout(ctx, options.deviceWaitTimeout())
+	defer cancel()
+	devicePath, err = nodeServer.host.waitForDevice(deviceCtx, nodeServer.iscsi, live, volumeMetaData.IQN)
 	if err != nil {
 		logger.Infof("devicePath error, %+v", err)
-		return nil, status.Errorf(codes.Unknown, "devicePath error, %+v", err)
-	}
-	scsiID, err := getScsiID(devicePath)
-	if err != nil {
-		logger.Infof("scsiID error, path %s, %+v", devicePath, err)
-		return nil, status.Errorf(codes.Unknown, "scsiIDerror, %+v", err)
+		return nil, status.Errorf(codes.DeadlineExceeded, "devicePath error, %+v", err)
 	}
-	bindings, discards, err := readBindings()
-	if err != nil {
-		logger.Infof("readBindings error, %+v", err)
-		return nil, status.Errorf(codes.Unknown, "readBindings error, %+v", err)
+	stagedDevice := mappedDevicePath(volumeName)
+	var wwid string
+	if mode == MultipathSinglePath {
+		// the link rather than the disk is recorded, since disks are renamed across restarts
+		stagedDevice, err = nodeServer.host.getDeviceLink(live[0], volumeMetaData.IQN)
+		if err != nil {
+			logger.Infof("device link error, %+v", err)
+			return nil, status.Errorf(codes.Unknown, "device link error, %+v", err)
+		}
+		portals = live
+	} else {
+		wwid, err = nodeServer.host.getScsiID(devicePath)
+		if err != nil {
+			logger.Infof("scsiID error, path %s, %+v", devicePath, err)
+			return nil, status.Errorf(codes.Unknown, "scsiIDerror, %+v", err)
+		}
+		backend, err := newMultipathBackend(mode, nodeServer.host)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "%v", err)
+		}
+		mapCtx, cancel := context.WithTimeout(ctx, options.deviceWaitTimeout())
+		defer cancel()
+		err = backend.Create(mapCtx, volumeName, wwid, devicePath)
+		if err != nil {
+			logger.Infof("multipath error, %+v", err)
+			return nil, status.Errorf(codes.Unknown, "multipath error, %+v", err)
+		}
 	}
-	bindings[volumeName] = scsiID
-	err = writeBindings(bindings)
+
+	// the record allows the volume to be unstaged once it has gone from the metadata
+	err = nodeServer.state.save(stagedVolume{
+		VolumeID:          in.VolumeId,
+		VolumeName:        volumeName,
+		IQN:               volumeMetaData.IQN,
+		Portals:           portals,
+		MultipathAlias:    volumeName,
+		Multipath:         mode,
+		Device:            stagedDevice,
+		WWID:              wwid,
+		StagingTargetPath: in.StagingTargetPath,
+	})
 	if err != nil {
-		logger.Infof("writeBindings error, %+v", err)
-		return nil, status.Errorf(codes.Unknown, "writeBindings error, %+v", err)
+		logger.Infof("state save error, %+v", err)
+		return nil, status.Errorf(codes.Unknown, "state save error, %+v", err)
 	}
-	for mappingName, _ := range discards {
-		multipath("-f", mappingName)
-	}
-	multipath(volumeName)
 
-	check, err := multipath("-ll", devicePath)
-	logger.Infof("multipath check for %s: %s", devicePath, check)
-	if check == "" {
-		logger.Infof("empty multipath check for %s", devicePath)
+	if block != nil {
+		// a raw block volume is neither formatted nor mounted, the staged device is published directly
+		logger.Infof("NodeStageVolume complete, block device")
+		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	blockInfo, err := getMappedDevice(volumeName)
+	// a read-only volume may be attached to several nodes, so it is neither formatted
+	// nor is its journal replayed, which would write to the device
+	readOnly := readOnlyAccessMode(in.VolumeCapability)
+
+	blockInfo, err := nodeServer.prober.GetBlockInfo(stagedDevice)
 	if err != nil {
-		logger.Infof("getMappedDevice error, %+v", err)
-		return nil, status.Errorf(codes.Unknown, "getMappedDevice error, %+v", err)
+		logger.Infof("GetBlockInfo error, %+v", err)
+		return nil, status.Errorf(codes.Unknown, "GetBlockInfo error, %+v", err)
 	}
 	if blockInfo.FsType == "" {
-		err = formatMappedDevice(volumeName)
+		if readOnly {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s has no filesystem and cannot be formatted for read-only access", volumeName)
+		}
+		if fsType == "" {
+			fsType = defaultFsType
+		}
+		logger.WithFields(logrus.Fields{"fsType": fsType, "mkfs_options": mkfsOptions, "device": stagedDevice}).Info("formatting device")
+		err = formatDevice(nodeServer.mounter, stagedDevice, fsType, mkfsOptions)
 		if err != nil {
-			logger.Infof("formatMappedDevice error, %+v", err)
-			return nil, status.Errorf(codes.Unknown, "formatMappedDevice error, %+v", err)
+			logger.Infof("formatDevice error, %+v", err)
+			return nil, status.Errorf(codes.Unknown, "formatDevice error, %+v", err)
 		}
+	} else {
+		// an existing filesystem is never mounted as another type
+		if fsType != "" && fsType != blockInfo.FsType {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s has an existing %s filesystem, %s requested", volumeName, blockInfo.FsType, fsType)
+		}
+		fsType = blockInfo.FsType
 	}
 
-	logger.Info("mounting mapped device")
-	err = mountMappedDevice(volumeName, in.StagingTargetPath)
+	var mountOptions []string
+	if readOnly {
+		mountOptions = readOnlyMountOptions(fsType)
+	}
+	mountOptions = append(mountOptions, mnt.GetMountFlags()...)
+
+	logger.WithFields(logrus.Fields{"fsType": fsType, "read_only": readOnly, "device": stagedDevice}).Info("mounting device")
+	err = mountDevice(nodeServer.mounter, stagedDevice, in.StagingTargetPath, fsType, mountOptions)
 	if err != nil {
-		logger.Infof("mountMappedDevice error, %v", err)
-		return nil, status.Errorf(codes.Unknown, "mountMappedDevice error, %+v", err)
+		logger.Infof("mountDevice error, %v", err)
+		return nil, status.Errorf(codes.Unknown, "mountDevice error, %+v", err)
 	}
 
 	logger.Infof("NodeStageVolume complete")
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// volumeTargets returns the iscsi targets published by the controller, or those from the metadata service
+// if they were not published
+func (nodeServer *PacketNodeServer) volumeTargets(ctx context.Context, volumeName string, publishInfo map[string]string) (packet.PacketVolumeMetadata, error) {
+	iqn, portals := publishInfo[publishInfoIQN], publishInfo[publishInfoPortals]
+	if iqn == "" || portals == "" {
+		return nodeServer.metadata.GetVolume(ctx, volumeName)
+	}
+	targets := packet.PacketVolumeMetadata{Name: volumeName, IQN: iqn}
+	for _, portal := range strings.Split(portals, ",") {
+		ip := net.ParseIP(strings.TrimSpace(portal))
+		if ip == nil {
+			return packet.PacketVolumeMetadata{}, fmt.Errorf("invalid portal %s published for %s", portal, volumeName)
+		}
+		targets.IPs = append(targets.IPs, ip)
+	}
+	return targets, nil
+}
+
+// waitForVolumeTargets waits for the volume to appear in the metadata, which follows its attachment;
+// on timeout the error lists the volumes which were found
+func (nodeServer *PacketNodeServer) waitForVolumeTargets(ctx context.Context, volumeName string, publishInfo map[string]string) (packet.PacketVolumeMetadata, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, nodeServer.Driver.options.deviceWaitTimeout())
+	defer cancel()
+
+	ticker := time.NewTicker(devicePollInterval)
+	defer ticker.Stop()
+	for {
+		targets, err := nodeServer.volumeTargets(waitCtx, volumeName, publishInfo)
+		if err == nil {
+			return targets, nil
+		}
+		if errors.Cause(err) != packet.ErrVolumeNotFound {
+			return targets, status.Errorf(codes.Unavailable, "metadata error, %v", err)
+		}
+
+		select {
+		case <-waitCtx.Done():
+			found := []string{}
+			if device, err := nodeServer.metadata.GetDevice(ctx); err == nil {
+				for _, volume := range device.Volumes {
+					found = append(found, volume.Name)
+				}
+			}
+			return targets, status.Errorf(codes.DeadlineExceeded, "timed out waiting for volume %s in metadata, found %v", volumeName, found)
+		case <-ticker.C:
+		}
+	}
+}
+
 // NodeUnstageVolume ~ iscisadmin, multipath
 func (nodeServer *PacketNodeServer) NodeUnstageVolume(ctx context.Context, in *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 
@@ -158,45 +329,70 @@ func (nodeServer *PacketNodeServer) NodeUnstageVolume(ctx context.Context, in *c
 		"method":              "NodeUnstageVolume",
 	})
 
-	err := unmountFs(in.StagingTargetPath)
+	// raw block volumes are not mounted at the staging path
+	mounted, err := isMounted(nodeServer.mounter, in.StagingTargetPath)
 	if err != nil {
-		return nil, status.Errorf(codes.Unknown, "unmounting error, %v", err)
+		return nil, status.Errorf(codes.Unknown, "mount table error, %v", err)
+	}
+	if mounted {
+		err = nodeServer.mounter.Unmount(in.StagingTargetPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Unknown, "unmounting error, %v", err)
+		}
+		logger.Infof("Unmounted staging target")
 	}
-	logger.Infof("Unmounted staging target")
 
-	volumeMetaData, err := packet.GetPacketVolumeMetadata(volumeName)
+	// the volume is torn down as recorded when staged, the metadata is consulted only
+	// for volumes staged before records were kept
+	staged, err := nodeServer.state.load(volumeName)
 	if err != nil {
-		return nil, status.Errorf(codes.Unknown, "metadata access error, %v ", err)
+		return nil, status.Errorf(codes.Unknown, "state load error, %v", err)
+	}
+	if staged == nil {
+		volumeMetaData, err := nodeServer.metadata.GetVolume(ctx, volumeName)
+		if err != nil {
+			return nil, status.Errorf(codes.Unknown, "metadata access error, %v ", err)
+		}
+		staged = &stagedVolume{
+			VolumeID:       volumeID,
+			VolumeName:     volumeName,
+			IQN:            volumeMetaData.IQN,
+			MultipathAlias: volumeName,
+			Multipath:      nodeServer.host.resolveMultipathBackend(nodeServer.Driver.options.multipathBackend()),
+		}
+		for _, ip := range volumeMetaData.IPs {
+			staged.Portals = append(staged.Portals, ip.String())
+		}
 	}
 
-	if len(volumeMetaData.IPs) == 0 {
+	if len(staged.Portals) == 0 {
 		return nil, status.Errorf(codes.Unknown, "volume %s has no portals", volumeName)
 	}
 
 	// remove multipath
-	bindings, discards, err := readBindings()
+	backend, err := newMultipathBackend(staged.Multipath, nodeServer.host)
 	if err != nil {
-		return nil, status.Errorf(codes.Unknown, "multipath error, %v", err)
+		return nil, status.Errorf(codes.Internal, "%v", err)
 	}
-	delete(bindings, volumeName)
-	err = writeBindings(bindings)
+	logger.WithField("backend", staged.Multipath).Info("multipath flush")
+	err = backend.Remove(staged.MultipathAlias, staged.WWID)
 	if err != nil {
 		return nil, status.Errorf(codes.Unknown, "multipath error, %v", err)
 	}
-	logger.Info("multipath flush")
-	for mappingName, _ := range discards {
-		multipath("-f", mappingName)
-	}
-	multipath("-f", volumeName)
 
-	for _, ip := range volumeMetaData.IPs {
-		logger.WithFields(logrus.Fields{"ip": ip, "iqn": volumeMetaData.IQN}).Info("iscsiadmin logout")
-		err = iscsiadminLogout(ip.String(), volumeMetaData.IQN)
+	for _, portal := range staged.Portals {
+		logger.WithFields(logrus.Fields{"ip": portal, "iqn": staged.IQN}).Info("iscsiadmin logout")
+		err = nodeServer.iscsi.Logout(portal, staged.IQN)
 		if err != nil {
 			return nil, status.Errorf(codes.Unknown, "iscsiadminLogout error, %v", err)
 		}
 	}
 
+	err = nodeServer.state.remove(volumeName)
+	if err != nil {
+		return nil, status.Errorf(codes.Unknown, "state remove error, %v", err)
+	}
+
 	logger.Info("NodeUnstageVolume complete")
 	response := &csi.NodeUnstageVolumeResponse{}
 	return response, nil
@@ -216,6 +412,9 @@ func (nodeServer *PacketNodeServer) NodePublishVolume(ctx context.Context, in *c
 	if in.StagingTargetPath == "" {
 		return nil, status.Error(codes.InvalidArgument, "StagingTargetPath unspecified for NodeStageVolume")
 	}
+	if in.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "VolumeCapability unspecified for NodePublishVolume")
+	}
 
 	logger := nodeServer.Driver.Logger.WithFields(logrus.Fields{
 		"volume_id":           in.VolumeId,
@@ -224,11 +423,50 @@ func (nodeServer *PacketNodeServer) NodePublishVolume(ctx context.Context, in *c
 		"method":              "NodePublishVolume",
 	})
 
-	err := bindmountFs(in.GetStagingTargetPath(), in.GetTargetPath())
+	if in.VolumeCapability.GetBlock() != nil {
+		volumeName := in.PublishInfo["VolumeName"]
+		if volumeName == "" {
+			volumeName = packet.VolumeIDToName(in.VolumeId)
+		}
+		devicePath, err := nodeServer.stagedDevicePath(ctx, volumeName)
+		if err != nil {
+			return nil, status.Errorf(codes.Unknown, "staged device error, %v", err)
+		}
+		published, err := checkBindmountDevice(nodeServer.mounter, nodeServer.prober, devicePath, in.GetTargetPath(), in.Readonly)
+		if errors.Cause(err) == errMountConflict {
+			return nil, status.Errorf(codes.AlreadyExists, "%v", err)
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Unknown, "mount table error, %v", err)
+		}
+		if published {
+			logger.Info("block device already published")
+			return &csi.NodePublishVolumeResponse{}, nil
+		}
+		err = bindmountDevice(nodeServer.mounter, devicePath, in.GetTargetPath(), in.Readonly)
+		if err != nil {
+			return nil, status.Errorf(codes.Unknown, "block device bind mount error, %+v", err)
+		}
+		logger.Info("block device bind mount complete")
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	published, err := checkBindMount(nodeServer.mounter, in.GetStagingTargetPath(), in.GetTargetPath(), in.Readonly)
+	if errors.Cause(err) == errMountConflict {
+		return nil, status.Errorf(codes.AlreadyExists, "%v", err)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Unknown, "mount table error, %v", err)
+	}
+	if published {
+		logger.Info("volume already published")
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	err = bindmountFs(nodeServer.mounter, in.GetStagingTargetPath(), in.GetTargetPath(), in.Readonly)
 	if err != nil {
 		return nil, status.Errorf(codes.Unknown, "bind mount error, %+v", err)
 	}
-	logger.Info("bind mount complete")
+	logger.WithField("read_only", in.Readonly).Info("bind mount complete")
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
@@ -250,29 +488,94 @@ func (nodeServer *PacketNodeServer) NodeUnpublishVolume(ctx context.Context, in
 		"method":      "NodePublishVolume",
 	})
 
-	err := unmountFs(in.GetTargetPath())
+	mounted, err := isMounted(nodeServer.mounter, in.GetTargetPath())
 	if err != nil {
-		return nil, status.Errorf(codes.Unknown, "unmount error, %+v", err)
+		return nil, status.Errorf(codes.Unknown, "mount table error, %v", err)
+	}
+	if mounted {
+		err = nodeServer.mounter.Unmount(in.GetTargetPath())
+		if err != nil {
+			return nil, status.Errorf(codes.Unknown, "unmount error, %+v", err)
+		}
+		logger.Info("unmount complete")
+	}
+
+	// the file created as the target of a block device bind mount is removed
+	if finfo, err := os.Stat(in.GetTargetPath()); err == nil && finfo.Mode().IsRegular() {
+		os.Remove(in.GetTargetPath())
 	}
-	logger.Info("unmount complete")
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
+// requiredPaths returns the number of portals which must be logged in, the configured minimum but at most
+// every portal; a volume with fewer portals than the minimum is staged with fewer paths than asked, so that is logged
+func requiredPaths(logger *logrus.Entry, minPaths int, portals []string) int {
+	if minPaths > len(portals) {
+		logger.WithFields(logrus.Fields{"min_paths": minPaths, "portals": portals}).Warn("fewer portals than the minimum paths, every portal is required")
+		return len(portals)
+	}
+	return minPaths
+}
+
+// stagedDevicePath returns the device recorded for the volume, or its multipath map if there is no record;
+// a multipathd map which multipathd has renamed since staging is first given back the volume's name
+func (nodeServer *PacketNodeServer) stagedDevicePath(ctx context.Context, volumeName string) (string, error) {
+	staged, err := nodeServer.state.load(volumeName)
+	if err != nil {
+		return "", err
+	}
+	if staged == nil {
+		return mappedDevicePath(volumeName), nil
+	}
+	if staged.Multipath == MultipathDaemon && staged.WWID != "" {
+		mapCtx, cancel := context.WithTimeout(ctx, multipathTimeout)
+		defer cancel()
+		if err := (&multipathDaemon{host: nodeServer.host}).restoreAlias(mapCtx, staged.MultipathAlias, staged.WWID); err != nil {
+			return "", err
+		}
+	}
+	return staged.devicePath(), nil
+}
+
+// nodeID is the id reported to the container orchestrator, either the configured node id
+// or, with the device-id strategy preferred, the packet device uuid from the metadata service
+func (nodeServer *PacketNodeServer) nodeID(ctx context.Context) (string, error) {
+	if nodeServer.Driver.options.nodeIDStrategies()[0] != NodeIDDeviceID {
+		return nodeServer.Driver.nodeID, nil
+	}
+	device, err := nodeServer.metadata.GetDevice(ctx)
+	if err != nil {
+		return "", status.Errorf(codes.Unavailable, "metadata error, %v", err)
+	}
+	if device.ID == "" {
+		return "", status.Error(codes.Unavailable, "metadata error, no device id")
+	}
+	return device.ID, nil
+}
+
 // NodeGetId
 func (nodeServer *PacketNodeServer) NodeGetId(ctx context.Context, in *csi.NodeGetIdRequest) (*csi.NodeGetIdResponse, error) {
 	nodeServer.Driver.Logger.Info("NodeGetId called")
+	nodeID, err := nodeServer.nodeID(ctx)
+	if err != nil {
+		return nil, err
+	}
 	return &csi.NodeGetIdResponse{
-		NodeId: nodeServer.Driver.nodeID,
+		NodeId: nodeID,
 	}, nil
 }
 
 // NodeGetInfo
-func (nodeServer *PacketNodeServer) NodeGetInfo(context.Context, *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+func (nodeServer *PacketNodeServer) NodeGetInfo(ctx context.Context, in *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	nodeServer.Driver.Logger.Info("NodeGetInfo called")
+	nodeID, err := nodeServer.nodeID(ctx)
+	if err != nil {
+		return nil, err
+	}
 	return &csi.NodeGetInfoResponse{
-		NodeId: nodeServer.Driver.nodeID,
-		// MaxVolumesPerNode: 0,
+		NodeId:            nodeID,
+		MaxVolumesPerNode: nodeServer.Driver.options.maxVolumesPerNode(),
 		// AccessibleTopology: nil,
 	}, nil
 }
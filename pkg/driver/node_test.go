@@ -1,33 +1,1071 @@
 package driver
 
-//
-//  three steps to mocking a single os/exec.Command call
-
-// func TestGetMappedDevice(t *testing.T) {
-// 	execCommand = fakeExecLsblk
-// 	defer func() { execCommand = exec.Command }()
-
-// 	blockInfo, err := getMappedDevice("md126")
-// 	assert.Nil(t, err)
-// 	assert.NotNil(t, blockInfo)
-// 	assert.Equal(t, "md126", blockInfo.Name)
-// 	assert.Equal(t, "ext4", blockInfo.FsType)
-// }
-
-// func TestMockOfLsblk(*testing.T) {
-// 	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
-// 		return
-// 	}
-// 	defer os.Exit(0)
-
-// 	lsblkStdout := `{"blockdevices":[{"name":"md126","fstype":"ext4","label":"ROOT","uuid":"afbc32b3-d258-4553-bd1b-4da06768c63f","mountpoint":"/"}]}`
-// 	fmt.Println(lsblkStdout)
-// }
-
-// func fakeExecLsblk(command string, args ...string) *exec.Cmd {
-// 	cs := []string{"-test.run=TestMockOfLsblk", "--", command}
-// 	cs = append(cs, args...)
-// 	cmd := exec.Command(os.Args[0], cs...)
-// 	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1"}
-// 	return cmd
-// }
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/packethost/csi-packet/pkg/packet"
+	"github.com/packethost/csi-packet/pkg/test"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMkfsArgs(t *testing.T) {
+	assert.Equal(t, []string{"-F", "/dev/mapper/volume-3ee59355"}, mkfsArgs("ext4", "/dev/mapper/volume-3ee59355", nil))
+	assert.Equal(t, []string{"-F", "-m", "0", "-E", "lazy_itable_init=1", "/dev/mapper/volume-3ee59355"},
+		mkfsArgs("ext4", "/dev/mapper/volume-3ee59355", []string{"-m", "0", "-E", "lazy_itable_init=1"}))
+	assert.Equal(t, []string{"-f", "/dev/mapper/volume-3ee59355"}, mkfsArgs("xfs", "/dev/mapper/volume-3ee59355", nil))
+	assert.Equal(t, []string{"-f", "/dev/mapper/volume-3ee59355"}, mkfsArgs("btrfs", "/dev/mapper/volume-3ee59355", nil))
+}
+
+func TestValidateMountFlags(t *testing.T) {
+	valid := [][]string{
+		nil,
+		{"noatime", "discard", "nobarrier"},
+		{`context="system_u:object_r:container_file_t:s0:c1,c2"`},
+		{"data=ordered", "commit=60", "errors=remount-ro"},
+	}
+	for _, flags := range valid {
+		assert.Nil(t, validateMountFlags(flags), "%v", flags)
+	}
+	invalid := [][]string{
+		{"suid"},
+		{"noatime", "dev"},
+		{"remount"},
+		{"bind"},
+		{"noatime=1"},
+		{"context"},
+		{"context=a;b"},
+		{"X-mount.mkdir"},
+		{"data=ordered,suid"},
+		{"errors=continue,dev"},
+		{"commit=5,exec"},
+		{"noatime,suid"},
+		{`data="ordered,suid"`},
+		{`context="system_u:object_r:container_file_t:s0",suid`},
+		{`context=system_u:object_r:container_file_t:s0:c1,c2`},
+	}
+	for _, flags := range invalid {
+		assert.NotNil(t, validateMountFlags(flags), "%v", flags)
+	}
+}
+
+func TestReadOnlyMountOptions(t *testing.T) {
+	assert.Equal(t, []string{"ro", "noload"}, readOnlyMountOptions("ext4"))
+	assert.Equal(t, []string{"ro", "norecovery"}, readOnlyMountOptions("xfs"))
+	assert.Equal(t, []string{"ro", "nologreplay"}, readOnlyMountOptions("btrfs"))
+}
+
+func TestParseMountInfo(t *testing.T) {
+	table := `22 1 253:0 / / rw,relatime shared:1 - ext4 /dev/vda1 rw
+120 22 252:1 / /var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv1/globalmount rw,relatime shared:60 - ext4 /dev/mapper/volume-3ee59355 rw,data=ordered
+130 22 252:1 / /var/lib/kubelet/pods/p1/volumes/kubernetes.io~csi/pv1/mount ro,relatime shared:60 - ext4 /dev/mapper/volume-3ee59355 rw,data=ordered
+140 22 0:6 /dm-1 /var/lib/kubelet/pods/p2/volumes/block\040device rw,nosuid shared:2 optional:3 - devtmpfs udev rw,size=4010628k
+malformed line
+`
+	mounts, err := parseMountInfo(strings.NewReader(table))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(mounts))
+	assert.Equal(t, "252:1", mounts[1].Device)
+	assert.Equal(t, "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv1/globalmount", mounts[1].MountPoint)
+	assert.Equal(t, "/dev/mapper/volume-3ee59355", mounts[1].Source)
+	assert.False(t, mounts[1].readOnly())
+	assert.True(t, mounts[2].readOnly())
+	assert.Equal(t, "/dm-1", mounts[3].Root)
+	assert.Equal(t, "/var/lib/kubelet/pods/p2/volumes/block device", mounts[3].MountPoint)
+	assert.Equal(t, "devtmpfs", mounts[3].FsType)
+}
+
+func TestStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-packet-state")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newStateStore(dir)
+	volume, err := store.load("volume-3ee59355")
+	assert.Nil(t, err)
+	assert.Nil(t, volume)
+
+	staged := stagedVolume{
+		VolumeID:          "3ee59355-a51a-42a8-b848-86626cc532f0",
+		VolumeName:        "volume-3ee59355",
+		IQN:               "iqn.2013-05.com.daterainc:tc:01:sn:b06f4c5b0ec7cbe6",
+		Portals:           []string{"10.144.144.226", "10.144.145.66"},
+		MultipathAlias:    "volume-3ee59355",
+		StagingTargetPath: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv1/globalmount",
+	}
+	assert.Nil(t, store.save(staged))
+	volume, err = store.load("volume-3ee59355")
+	assert.Nil(t, err)
+	assert.Equal(t, &staged, volume)
+
+	volumes, err := store.list()
+	assert.Nil(t, err)
+	assert.Equal(t, []stagedVolume{staged}, volumes)
+
+	assert.Nil(t, store.remove("volume-3ee59355"))
+	assert.Nil(t, store.remove("volume-3ee59355"))
+	volumes, err = store.list()
+	assert.Nil(t, err)
+	assert.Empty(t, volumes)
+}
+
+func TestParseIscsiTargets(t *testing.T) {
+	sessions := `tcp: [1] 10.144.144.226:3260,1 iqn.2013-05.com.daterainc:tc:01:sn:b06f4c5b0ec7cbe6 (non-flash)
+tcp: [2] 10.144.145.66:3260,1 iqn.2013-05.com.daterainc:tc:01:sn:b06f4c5b0ec7cbe6 (non-flash)
+`
+	assert.Equal(t, []ISCSITarget{
+		{Portal: "10.144.144.226", IQN: "iqn.2013-05.com.daterainc:tc:01:sn:b06f4c5b0ec7cbe6"},
+		{Portal: "10.144.145.66", IQN: "iqn.2013-05.com.daterainc:tc:01:sn:b06f4c5b0ec7cbe6"},
+	}, parseIscsiTargets(sessions))
+
+	nodes := "10.144.144.226:3260,1 iqn.2013-05.com.daterainc:tc:01:sn:b06f4c5b0ec7cbe6\n"
+	assert.Equal(t, []ISCSITarget{{Portal: "10.144.144.226", IQN: "iqn.2013-05.com.daterainc:tc:01:sn:b06f4c5b0ec7cbe6"}}, parseIscsiTargets(nodes))
+	assert.Empty(t, parseIscsiTargets("iscsiadm: No active sessions.\n"))
+}
+
+func TestNodeGetIdDeviceID(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.restore()
+	driver, err := NewPacketDriver("unix:///csi/csi.sock", "node1", "", Options{NodeIDStrategies: []string{NodeIDDeviceID}})
+	assert.Nil(t, err)
+	metadata := &test.FakeMetadataClient{Device: packet.PacketDeviceMetadata{ID: "6b7f3a0b-ee1b-4d0b-9a8d-4d4e1d56a8e4"}}
+	nodeServer := &PacketNodeServer{Driver: driver, metadata: metadata}
+
+	resp, err := nodeServer.NodeGetId(context.TODO(), &csi.NodeGetIdRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, "6b7f3a0b-ee1b-4d0b-9a8d-4d4e1d56a8e4", resp.NodeId)
+
+	metadata.Err = errors.New("metadata unreachable")
+	_, err = nodeServer.NodeGetId(context.TODO(), &csi.NodeGetIdRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestVolumeTargets(t *testing.T) {
+	metadata := &test.FakeMetadataClient{Device: packet.PacketDeviceMetadata{
+		Volumes: []packet.PacketVolumeMetadata{
+			{Name: "volume-3ee59355", IQN: "iqn.2013-05.com.daterainc:tc:01:sn:metadata", IPs: []net.IP{net.ParseIP("10.144.144.1")}},
+		},
+	}}
+	nodeServer := &PacketNodeServer{metadata: metadata}
+
+	targets, err := nodeServer.volumeTargets(context.TODO(), "volume-3ee59355", map[string]string{
+		"VolumeName": "volume-3ee59355",
+		"IQN":        "iqn.2013-05.com.daterainc:tc:01:sn:published",
+		"Portals":    "10.144.144.226,10.144.145.66",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "iqn.2013-05.com.daterainc:tc:01:sn:published", targets.IQN)
+	assert.Equal(t, []net.IP{net.ParseIP("10.144.144.226"), net.ParseIP("10.144.145.66")}, targets.IPs)
+
+	targets, err = nodeServer.volumeTargets(context.TODO(), "volume-3ee59355", map[string]string{"VolumeName": "volume-3ee59355"})
+	assert.Nil(t, err)
+	assert.Equal(t, "iqn.2013-05.com.daterainc:tc:01:sn:metadata", targets.IQN)
+
+	_, err = nodeServer.volumeTargets(context.TODO(), "volume-3ee59355", map[string]string{"IQN": "iqn", "Portals": "portal"})
+	assert.NotNil(t, err)
+}
+
+func TestWaitForVolumeTargets(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.restore()
+
+	driver, err := NewPacketDriver("unix:///csi/csi.sock", "node1", "", Options{DeviceWaitTimeout: 20 * time.Millisecond})
+	assert.Nil(t, err)
+	metadata := &test.FakeMetadataClient{Device: packet.PacketDeviceMetadata{
+		Volumes: []packet.PacketVolumeMetadata{{Name: "volume-1a2b3c4d"}},
+	}}
+	nodeServer := &PacketNodeServer{Driver: driver, metadata: metadata}
+
+	_, err = nodeServer.waitForVolumeTargets(context.TODO(), "volume-3ee59355", nil)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Contains(t, err.Error(), "volume-1a2b3c4d")
+
+	metadata.Device.Volumes = append(metadata.Device.Volumes, packet.PacketVolumeMetadata{Name: "volume-3ee59355", IQN: "iqn"})
+	targets, err := nodeServer.waitForVolumeTargets(context.TODO(), "volume-3ee59355", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "iqn", targets.IQN)
+
+	metadata.Err = errors.New("metadata unreachable")
+	_, err = nodeServer.waitForVolumeTargets(context.TODO(), "volume-3ee59355", nil)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+const (
+	testVolumeID   = "3ee59355-a51a-42a8-b848-86626cc532f0"
+	testVolumeName = "volume-3ee59355"
+	testIQN        = "iqn.2013-05.com.daterainc:tc:01:sn:b06f4c5b0ec7cbe6"
+)
+
+// newTestNodeServer returns a node server on a fake host, with its state in the host's directory
+func newTestNodeServer(t *testing.T, iscsi ISCSI, options Options) (*PacketNodeServer, *fakeHost) {
+	host := newFakeHost(t)
+	options.StateDir = filepath.Join(host.dir, "state")
+	if options.HostLayout == "" {
+		options.HostLayout = HostLayoutClassic
+	}
+	driver, err := NewPacketDriver("unix:///csi/csi.sock", "node1", "", options)
+	assert.Nil(t, err)
+	host.install(driver)
+	mounter := newFakeMounter()
+	nodeServer := NewPacketNodeServer(driver, iscsi, mounter, mounter)
+	nodeServer.metadata = &test.FakeMetadataClient{Err: errors.New("metadata unreachable")}
+	return nodeServer, host
+}
+
+func testStageRequest(dir string) *csi.NodeStageVolumeRequest {
+	return &csi.NodeStageVolumeRequest{
+		VolumeId: testVolumeID,
+		PublishInfo: map[string]string{
+			"VolumeName": testVolumeName,
+			"IQN":        testIQN,
+			"Portals":    "10.144.144.226,10.144.145.66",
+		},
+		StagingTargetPath: filepath.Join(dir, "globalmount"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+}
+
+func TestNodeStageVolumeNoPaths(t *testing.T) {
+	iscsi := newFakeISCSI(testIQN, "10.144.144.226", "10.144.145.66")
+	iscsi.unreachable["10.144.144.226"] = true
+	iscsi.unreachable["10.144.145.66"] = true
+	nodeServer, host := newTestNodeServer(t, iscsi, Options{})
+	defer host.restore()
+
+	_, err := nodeServer.NodeStageVolume(context.TODO(), testStageRequest(nodeServer.state.dir))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	sessions, _ := iscsi.Sessions()
+	assert.Empty(t, sessions)
+}
+
+func TestNodeStageVolumeDegraded(t *testing.T) {
+	iscsi := newFakeISCSI(testIQN, "10.144.144.226", "10.144.145.66")
+	iscsi.unreachable["10.144.144.226"] = true
+
+	// two paths are required
+	nodeServer, host := newTestNodeServer(t, iscsi, Options{MinPaths: 2})
+	_, err := nodeServer.NodeStageVolume(context.TODO(), testStageRequest(nodeServer.state.dir))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	host.restore()
+
+	// one path suffices, the disk is looked for at the live path, which is rescanned when it does not appear
+	nodeServer, host = newTestNodeServer(t, iscsi, Options{DeviceWaitTimeout: 20 * time.Millisecond})
+	defer host.restore()
+	_, err = nodeServer.NodeStageVolume(context.TODO(), testStageRequest(nodeServer.state.dir))
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Contains(t, err.Error(), testIQN)
+	sessions, _ := iscsi.Sessions()
+	assert.Equal(t, []ISCSITarget{{Portal: "10.144.145.66", IQN: testIQN}}, sessions)
+	assert.NotEmpty(t, iscsi.rescans)
+	for _, rescan := range iscsi.rescans {
+		assert.Equal(t, "10.144.145.66", rescan.Portal)
+	}
+}
+
+func TestLoginPortals(t *testing.T) {
+	iscsi := newFakeISCSI(testIQN, "10.144.144.226", "10.144.145.66", "10.144.146.10")
+	iscsi.unreachable["10.144.144.226"] = true
+	iscsi.hanging["10.144.146.10"] = true
+
+	// the portals are logged in together, a hanging login fails at the timeout without holding up the others
+	start := time.Now()
+	live, failed := loginPortals(context.TODO(), iscsi, []string{"10.144.144.226", "10.144.145.66", "10.144.146.10"}, testIQN, 20*time.Millisecond)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, []string{"10.144.145.66"}, live)
+	assert.Equal(t, 2, len(failed))
+	assert.Contains(t, failed["10.144.144.226"].Error(), "cannot connect")
+	assert.Contains(t, failed["10.144.146.10"].Error(), "timed out after 20ms")
+	sessions, _ := iscsi.Sessions()
+	assert.Equal(t, []ISCSITarget{{Portal: "10.144.145.66", IQN: testIQN}}, sessions)
+
+	// the minimum is required of as many portals as there are
+	logger := logrus.NewEntry(logrus.New())
+	assert.Equal(t, 2, requiredPaths(logger, 2, []string{"10.144.144.226", "10.144.145.66", "10.144.146.10"}))
+	assert.Equal(t, 1, requiredPaths(logger, 2, []string{"10.144.145.66"}))
+}
+
+func TestNodeStageVolumeMinPaths(t *testing.T) {
+	iscsi := newFakeISCSI(testIQN, "10.144.144.226", "10.144.145.66")
+	iscsi.hanging["10.144.144.226"] = true
+
+	// a hanging portal does not count towards the minimum
+	nodeServer, host := newTestNodeServer(t, iscsi, Options{MinPaths: 2, PortalLoginTimeout: 20 * time.Millisecond})
+	_, err := nodeServer.NodeStageVolume(context.TODO(), testStageRequest(nodeServer.state.dir))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Contains(t, err.Error(), "1 of 2 paths up, 2 required")
+	host.restore()
+
+	// a minimum above the number of portals requires each of them, past which staging waits for the disk
+	delete(iscsi.hanging, "10.144.144.226")
+	nodeServer, host = newTestNodeServer(t, iscsi, Options{MinPaths: 3, DeviceWaitTimeout: 20 * time.Millisecond})
+	defer host.restore()
+	_, err = nodeServer.NodeStageVolume(context.TODO(), testStageRequest(nodeServer.state.dir))
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	sessions, _ := iscsi.Sessions()
+	assert.Equal(t, 2, len(sessions))
+}
+
+func TestNodeStageVolumeSinglePath(t *testing.T) {
+	iscsi := newFakeISCSI(testIQN, "10.144.144.226", "10.144.145.66")
+	iscsi.unreachable["10.144.144.226"] = true
+
+	// the portals are tried in turn until one logs in, the others are left alone
+	nodeServer, host := newTestNodeServer(t, iscsi, Options{MultipathBackend: MultipathSinglePath, MinPaths: 2, DeviceWaitTimeout: 20 * time.Millisecond})
+	defer host.restore()
+	_, err := nodeServer.NodeStageVolume(context.TODO(), testStageRequest(nodeServer.state.dir))
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	sessions, _ := iscsi.Sessions()
+	assert.Equal(t, []ISCSITarget{{Portal: "10.144.145.66", IQN: testIQN}}, sessions)
+
+	delete(iscsi.unreachable, "10.144.144.226")
+	assert.Nil(t, iscsi.Logout("10.144.145.66", testIQN))
+	_, err = nodeServer.NodeStageVolume(context.TODO(), testStageRequest(nodeServer.state.dir))
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	sessions, _ = iscsi.Sessions()
+	assert.Equal(t, []ISCSITarget{{Portal: "10.144.144.226", IQN: testIQN}}, sessions)
+
+	// once the disk appears it is formatted and mounted through its link, which is recorded
+	link := filepath.Join(host.layout.diskByPath, "ip-10.144.144.226:3260-iscsi-"+testIQN+"-lun-0")
+	disk := filepath.Join(host.dir, "sdb")
+	assert.Nil(t, ioutil.WriteFile(disk, nil, 0644))
+	assert.Nil(t, os.Symlink(disk, link))
+	mounter := nodeServer.mounter.(*fakeMounter)
+	mounter.addDevice(link, "8:16", disk, "")
+	request := testStageRequest(nodeServer.state.dir)
+	request.VolumeCapability.AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}
+	_, err = nodeServer.NodeStageVolume(context.TODO(), request)
+	assert.Nil(t, err)
+	record, err := nodeServer.state.load(testVolumeName)
+	assert.Nil(t, err)
+	assert.Equal(t, MultipathSinglePath, record.Multipath)
+	assert.Equal(t, link, record.Device)
+	assert.Equal(t, []string{"10.144.144.226"}, record.Portals)
+	assert.Equal(t, []string{"mkfs.ext4 -F " + link, "mount -t ext4 -o  " + link + " " + request.StagingTargetPath}, mounter.calls)
+	for _, command := range host.ran() {
+		assert.False(t, strings.Contains(command, "multipath") || strings.Contains(command, "dmsetup"), command)
+	}
+}
+
+func TestResolveMultipathBackend(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.restore()
+
+	// auto uses the multipath tool only where the host has it
+	assert.Equal(t, MultipathSinglePath, host.resolveMultipathBackend(MultipathAuto))
+	assert.Nil(t, os.MkdirAll(filepath.Dir(host.layout.multipathExec), 0755))
+	assert.Nil(t, ioutil.WriteFile(host.layout.multipathExec, nil, 0755))
+	assert.Equal(t, MultipathTool, host.resolveMultipathBackend(MultipathAuto))
+	assert.Equal(t, MultipathDmsetup, host.resolveMultipathBackend(MultipathDmsetup))
+
+	// the host's multipath is looked for through the host root
+	host.exec = hostExecConfig{mode: ExecChroot, hostRoot: host.dir}
+	host.layout.multipathExec = "/sbin/multipath"
+	assert.Equal(t, MultipathTool, host.resolveMultipathBackend(MultipathAuto))
+	host.exec.hostRoot = filepath.Join(host.dir, "sys")
+	assert.Equal(t, MultipathSinglePath, host.resolveMultipathBackend(MultipathAuto))
+}
+
+func TestNodeUnstageVolumeSinglePath(t *testing.T) {
+	iscsi := newFakeISCSI(testIQN, "10.144.144.226", "10.144.145.66")
+	iscsi.sessions[ISCSITarget{Portal: "10.144.145.66", IQN: testIQN}] = true
+	nodeServer, host := newTestNodeServer(t, iscsi, Options{})
+	defer host.restore()
+	mounter := nodeServer.mounter.(*fakeMounter)
+
+	// the device of a single path volume is mounted, there is no map to flush
+	staging := filepath.Join(nodeServer.state.dir, "globalmount")
+	device := "/dev/disk/by-path/ip-10.144.145.66:3260-iscsi-" + testIQN + "-lun-0"
+	mounter.addDevice(device, "8:16", "/dev/sdb", "ext4")
+	assert.Nil(t, mounter.Mount(device, staging, "ext4", nil))
+	bindings := testVolumeName + " 36001405a1b2c3d4\n"
+	assert.Nil(t, ioutil.WriteFile(host.layout.multipathBindings, []byte(bindings), 0644))
+	assert.Nil(t, nodeServer.state.save(stagedVolume{
+		VolumeID:          testVolumeID,
+		VolumeName:        testVolumeName,
+		IQN:               testIQN,
+		Portals:           []string{"10.144.145.66"},
+		MultipathAlias:    testVolumeName,
+		Multipath:         MultipathSinglePath,
+		Device:            device,
+		StagingTargetPath: staging,
+	}))
+
+	// a repeated stage finds the recorded device mounted
+	request := testStageRequest(nodeServer.state.dir)
+	request.VolumeCapability.AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}
+	_, err := nodeServer.NodeStageVolume(context.TODO(), request)
+	assert.Nil(t, err)
+
+	_, err = nodeServer.NodeUnstageVolume(context.TODO(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          testVolumeID,
+		StagingTargetPath: staging,
+	})
+	assert.Nil(t, err)
+	mounted, _ := isMounted(mounter, staging)
+	assert.False(t, mounted)
+	sessions, _ := iscsi.Sessions()
+	assert.Empty(t, sessions)
+	data, err := ioutil.ReadFile(host.layout.multipathBindings)
+	assert.Nil(t, err)
+	assert.Equal(t, bindings, string(data), "the bindings are not touched")
+}
+
+func TestNodeUnstageVolume(t *testing.T) {
+	iscsi := newFakeISCSI(testIQN, "10.144.144.226", "10.144.145.66")
+	other := ISCSITarget{Portal: "10.144.144.226", IQN: "iqn.2013-05.com.daterainc:tc:01:sn:other"}
+	iscsi.sessions[ISCSITarget{Portal: "10.144.144.226", IQN: testIQN}] = true
+	iscsi.sessions[ISCSITarget{Portal: "10.144.145.66", IQN: testIQN}] = true
+	iscsi.sessions[other] = true
+	nodeServer, host := newTestNodeServer(t, iscsi, Options{})
+	defer host.restore()
+
+	// the volume is no longer in the metadata, it is unstaged from its record
+	staging := filepath.Join(nodeServer.state.dir, "globalmount")
+	assert.Nil(t, nodeServer.state.save(stagedVolume{
+		VolumeID:          testVolumeID,
+		VolumeName:        testVolumeName,
+		IQN:               testIQN,
+		Portals:           []string{"10.144.144.226", "10.144.145.66"},
+		MultipathAlias:    testVolumeName,
+		StagingTargetPath: staging,
+	}))
+	assert.Nil(t, ioutil.WriteFile(host.layout.multipathBindings, []byte(testVolumeName+" 36001405a1b2c3d4\nvolume-1a2b3c4d 36001405e5f6a7b8\n"), 0644))
+
+	_, err := nodeServer.NodeUnstageVolume(context.TODO(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          testVolumeID,
+		StagingTargetPath: staging,
+	})
+	assert.Nil(t, err)
+
+	sessions, _ := iscsi.Sessions()
+	assert.Equal(t, []ISCSITarget{other}, sessions)
+	bindings, _, err := host.readBindings()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"volume-1a2b3c4d": "36001405e5f6a7b8"}, bindings)
+	record, err := nodeServer.state.load(testVolumeName)
+	assert.Nil(t, err)
+	assert.Nil(t, record)
+
+	// without a record the metadata is consulted
+	_, err = nodeServer.NodeUnstageVolume(context.TODO(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          testVolumeID,
+		StagingTargetPath: staging,
+	})
+	assert.Equal(t, codes.Unknown, status.Code(err))
+}
+
+func TestReconcileLeavesHostMaps(t *testing.T) {
+	packetSession := ISCSITarget{Portal: "10.144.144.226", IQN: testIQN}
+	hostSession := ISCSITarget{Portal: "10.0.0.1", IQN: "iqn.2005-10.org.freenas.ctl:data"}
+	iscsi := newFakeISCSI(testIQN, "10.144.144.226")
+	iscsi.sessions[packetSession] = true
+	iscsi.sessions[hostSession] = true
+	nodeServer, host := newTestNodeServer(t, iscsi, Options{})
+	defer host.restore()
+
+	// the disk of the packet session is held by a map no volume owns, that of the host session by the host's map
+	dir := host.dir
+	disks := map[string]ISCSITarget{"sdb": packetSession, "sda": hostSession}
+	maps := map[string]string{"sdb": "volume-1a2b3c4d", "sda": "mpatha"}
+	for i, disk := range []string{"sda", "sdb"} {
+		target := disks[disk]
+		link := filepath.Join(host.layout.diskByPath, fmt.Sprintf("ip-%s:3260-iscsi-%s-lun-0", target.Portal, target.IQN))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, disk), nil, 0644))
+		assert.Nil(t, os.Symlink(filepath.Join(dir, disk), link))
+		holder := fmt.Sprintf("dm-%d", i)
+		assert.Nil(t, os.MkdirAll(filepath.Join(sysfsBlock, disk, "holders", holder), 0755))
+		assert.Nil(t, os.MkdirAll(filepath.Join(sysfsBlock, holder, "dm"), 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(sysfsBlock, holder, "dm", "name"), []byte(maps[disk]+"\n"), 0644))
+	}
+	bindings := "mpatha 36589cfc000000e1\ndata 36589cfc000000f2\nvolume-1a2b3c4d 36001405e5f6a7b8\n" + testVolumeName + " 36001405a1b2c3d4\n"
+	assert.Nil(t, ioutil.WriteFile(host.layout.multipathBindings, []byte(bindings), 0644))
+	assert.Nil(t, nodeServer.state.save(stagedVolume{
+		VolumeID:          testVolumeID,
+		VolumeName:        testVolumeName,
+		IQN:               testIQN,
+		Portals:           []string{"10.144.145.66"},
+		MultipathAlias:    testVolumeName,
+		StagingTargetPath: filepath.Join(dir, "globalmount"),
+	}))
+
+	plan, volumes, err := nodeServer.planReconcile(nodeServer.Driver.Logger)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, volumes)
+	assert.Equal(t, []string{"volume-1a2b3c4d"}, plan.maps, "the host's mpatha map is kept")
+	assert.Equal(t, []string{"volume-1a2b3c4d"}, plan.aliases, "the host's aliases are kept")
+	assert.Equal(t, []ISCSITarget{packetSession}, plan.sessions)
+
+	// report is the default, nothing is changed
+	assert.Equal(t, ReconcileReport, nodeServer.Driver.options.reconcile())
+	assert.Nil(t, nodeServer.reconcile(true))
+	data, err := ioutil.ReadFile(host.layout.multipathBindings)
+	assert.Nil(t, err)
+	assert.Equal(t, bindings, string(data))
+	sessions, _ := iscsi.Sessions()
+	assert.Equal(t, 2, len(sessions))
+}
+
+func TestNodeStageVolumeAlreadyStaged(t *testing.T) {
+	iscsi := newFakeISCSI(testIQN, "10.144.144.226", "10.144.145.66")
+	nodeServer, host := newTestNodeServer(t, iscsi, Options{})
+	defer host.restore()
+	mounter := nodeServer.mounter.(*fakeMounter)
+
+	request := testStageRequest(nodeServer.state.dir)
+	request.VolumeCapability.AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}
+	mounter.addDevice("/dev/mapper/"+testVolumeName, "252:1", "/dev/dm-1", "ext4")
+	mounter.addDevice("/dev/mapper/volume-1a2b3c4d", "252:2", "/dev/dm-2", "ext4")
+	assert.Nil(t, mounter.Mount("/dev/mapper/"+testVolumeName, request.StagingTargetPath, "ext4", nil))
+
+	_, err := nodeServer.NodeStageVolume(context.TODO(), request)
+	assert.Nil(t, err)
+	sessions, _ := iscsi.Sessions()
+	assert.Empty(t, sessions, "nothing is done for a staged volume")
+	assert.Equal(t, 1, len(mounter.calls))
+
+	// another volume at the staging path is a conflict
+	assert.Nil(t, mounter.Unmount(request.StagingTargetPath))
+	assert.Nil(t, mounter.Mount("/dev/mapper/volume-1a2b3c4d", request.StagingTargetPath, "ext4", nil))
+	_, err = nodeServer.NodeStageVolume(context.TODO(), request)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+func TestNodeStageVolumeBlockAlreadyStaged(t *testing.T) {
+	iscsi := newFakeISCSI(testIQN, "10.144.144.226", "10.144.145.66")
+	nodeServer, host := newTestNodeServer(t, iscsi, Options{MultipathBackend: MultipathDaemon, DeviceWaitTimeout: 20 * time.Millisecond})
+	defer host.restore()
+	mounter := nodeServer.mounter.(*fakeMounter)
+	request := testStageRequest(nodeServer.state.dir)
+	assert.Nil(t, nodeServer.state.save(stagedVolume{
+		VolumeID:          testVolumeID,
+		VolumeName:        testVolumeName,
+		IQN:               testIQN,
+		Portals:           []string{"10.144.144.226", "10.144.145.66"},
+		MultipathAlias:    testVolumeName,
+		Multipath:         MultipathDaemon,
+		WWID:              "36001405a1b2c3d4",
+		StagingTargetPath: request.StagingTargetPath,
+	}))
+
+	// the recorded map, which multipathd named back, is given the alias again and nothing else is done
+	host.run = func(command string) ([]byte, error) {
+		if command == "multipathd show maps json" {
+			return []byte(`{"maps": [{"name": "mpatha", "uuid": "36001405a1b2c3d4", "sysfs": "dm-1", "dm_st": "active"}]}`), nil
+		}
+		return []byte("ok\n"), nil
+	}
+	mounter.addDevice("/dev/mapper/"+testVolumeName, "252:1", "/dev/dm-1", "")
+	_, err := nodeServer.NodeStageVolume(context.TODO(), request)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"multipathd show maps json", "dmsetup rename mpatha " + testVolumeName}, host.ran())
+	sessions, _ := iscsi.Sessions()
+	assert.Empty(t, sessions)
+
+	// without its device the volume is staged again
+	delete(mounter.devices, "/dev/mapper/"+testVolumeName)
+	_, err = nodeServer.NodeStageVolume(context.TODO(), request)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	sessions, _ = iscsi.Sessions()
+	assert.Equal(t, 2, len(sessions))
+}
+
+func TestNodePublishVolume(t *testing.T) {
+	nodeServer, host := newTestNodeServer(t, newFakeISCSI(testIQN), Options{})
+	defer host.restore()
+	mounter := nodeServer.mounter.(*fakeMounter)
+
+	staging := filepath.Join(nodeServer.state.dir, "globalmount")
+	target := filepath.Join(nodeServer.state.dir, "pods", "mount")
+	mounter.addDevice("/dev/mapper/"+testVolumeName, "252:1", "/dev/dm-1", "ext4")
+	assert.Nil(t, mounter.Mount("/dev/mapper/"+testVolumeName, staging, "ext4", nil))
+
+	request := &csi.NodePublishVolumeRequest{
+		VolumeId:          testVolumeID,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+	_, err := nodeServer.NodePublishVolume(context.TODO(), request)
+	assert.Nil(t, err)
+	info, err := getMountInfo(mounter, target)
+	assert.Nil(t, err)
+	assert.Equal(t, "252:1", info.Device)
+
+	// a repeated publish finds the bind mount
+	_, err = nodeServer.NodePublishVolume(context.TODO(), request)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(mounter.calls))
+
+	// but not with other access
+	request.Readonly = true
+	_, err = nodeServer.NodePublishVolume(context.TODO(), request)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	unpublish := &csi.NodeUnpublishVolumeRequest{VolumeId: testVolumeID, TargetPath: target}
+	_, err = nodeServer.NodeUnpublishVolume(context.TODO(), unpublish)
+	assert.Nil(t, err)
+	mounted, _ := isMounted(mounter, target)
+	assert.False(t, mounted)
+	_, err = nodeServer.NodeUnpublishVolume(context.TODO(), unpublish)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(mounter.calls), "an unmounted target is not unmounted again")
+
+	_, err = nodeServer.NodePublishVolume(context.TODO(), request)
+	assert.Nil(t, err)
+	info, _ = getMountInfo(mounter, target)
+	assert.True(t, info.readOnly())
+}
+
+func TestNodePublishVolumeBlock(t *testing.T) {
+	nodeServer, host := newTestNodeServer(t, newFakeISCSI(testIQN), Options{})
+	defer host.restore()
+	mounter := nodeServer.mounter.(*fakeMounter)
+	mounter.addDevice("/dev/mapper/"+testVolumeName, "252:1", "/dev/dm-1", "")
+
+	target := filepath.Join(nodeServer.state.dir, "pods", "block")
+	request := &csi.NodePublishVolumeRequest{
+		VolumeId:          testVolumeID,
+		PublishInfo:       map[string]string{"VolumeName": testVolumeName},
+		StagingTargetPath: filepath.Join(nodeServer.state.dir, "globalmount"),
+		TargetPath:        target,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+	_, err := nodeServer.NodePublishVolume(context.TODO(), request)
+	assert.Nil(t, err)
+	finfo, err := os.Stat(target)
+	assert.Nil(t, err)
+	assert.True(t, finfo.Mode().IsRegular())
+	info, _ := getMountInfo(mounter, target)
+	assert.Equal(t, "/dm-1", info.Root)
+
+	_, err = nodeServer.NodePublishVolume(context.TODO(), request)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"mount --bind /dev/mapper/volume-3ee59355 " + target + " ro=false"}, mounter.calls)
+
+	_, err = nodeServer.NodeUnpublishVolume(context.TODO(), &csi.NodeUnpublishVolumeRequest{VolumeId: testVolumeID, TargetPath: target})
+	assert.Nil(t, err)
+	_, err = os.Stat(target)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestModifyBindings(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.restore()
+	dir := filepath.Join(host.dir, "multipath")
+	assert.Nil(t, os.MkdirAll(dir, 0755))
+	host.layout.multipathBindings = filepath.Join(dir, "bindings")
+
+	original := `# Multipath bindings, Version : 1.0
+# NOTE: this file is automatically maintained by the multipath program.
+volume-1a2b3c4d 36001405e5f6a7b8
+mpatha 36001405c9d0e1f2
+
+volume-3ee59355 36001405a1b2c3d4
+`
+	assert.Nil(t, ioutil.WriteFile(host.layout.multipathBindings, []byte(original), 0600))
+
+	// comments and ordering are kept, a rebound alias stays in place
+	err := host.modifyBindings(func(table *bindingTable) {
+		table.set("volume-1a2b3c4d", "36001405ffffffff")
+		table.remove("mpatha")
+		table.set("volume-5e6f7a8b", "3600140500000000")
+	})
+	assert.Nil(t, err)
+	data, err := ioutil.ReadFile(host.layout.multipathBindings)
+	assert.Nil(t, err)
+	assert.Equal(t, `# Multipath bindings, Version : 1.0
+# NOTE: this file is automatically maintained by the multipath program.
+volume-1a2b3c4d 36001405ffffffff
+
+volume-3ee59355 36001405a1b2c3d4
+volume-5e6f7a8b 3600140500000000
+`, string(data))
+
+	// concurrent changes are serialized
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Nil(t, host.modifyBindings(func(table *bindingTable) {
+				table.set(fmt.Sprintf("volume-%08d", i), fmt.Sprintf("36001405%08d", i))
+			}))
+		}(i)
+	}
+	wg.Wait()
+	bindings, discards, err := host.readBindings()
+	assert.Nil(t, err)
+	assert.Empty(t, discards)
+	assert.Equal(t, 23, len(bindings))
+
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, file := range files {
+		assert.Equal(t, "bindings", file.Name(), "no temporary files are left")
+	}
+
+	// the file is rewritten in place, so that a binding which multipath appends to the file it has open is kept
+	appender, err := os.OpenFile(host.layout.multipathBindings, os.O_WRONLY|os.O_APPEND, 0)
+	assert.Nil(t, err)
+	defer appender.Close()
+	assert.Nil(t, host.modifyBindings(func(table *bindingTable) { table.remove("volume-00000000") }))
+	_, err = appender.WriteString("mpathb 36001405abababab\n")
+	assert.Nil(t, err)
+	bindings, discards, err = host.readBindings()
+	assert.Nil(t, err)
+	assert.Equal(t, 22, len(bindings))
+	assert.Equal(t, map[string]string{"mpathb": "36001405abababab"}, discards)
+}
+
+// fOFDSetlk is F_OFD_SETLK, which syscall lacks; an open file description lock conflicts with the
+// process locks of multipath, and of this process
+const fOFDSetlk = 37
+
+func TestModifyBindingsLock(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.restore()
+	assert.Nil(t, ioutil.WriteFile(host.layout.multipathBindings, []byte("volume-1a2b3c4d 36001405e5f6a7b8\n"), 0600))
+
+	// while multipath holds its lock on the bindings file, they are not changed
+	holder, err := os.OpenFile(host.layout.multipathBindings, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	defer holder.Close()
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	assert.Nil(t, syscall.FcntlFlock(holder.Fd(), fOFDSetlk, &lock))
+	done := make(chan error)
+	go func() {
+		done <- host.modifyBindings(func(table *bindingTable) { table.set(testVolumeName, "36001405a1b2c3d4") })
+	}()
+	select {
+	case <-done:
+		t.Fatal("the bindings are changed while locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	lock.Type = syscall.F_UNLCK
+	assert.Nil(t, syscall.FcntlFlock(holder.Fd(), fOFDSetlk, &lock))
+	assert.Nil(t, <-done)
+	bindings, _, err := host.readBindings()
+	assert.Nil(t, err)
+	assert.Equal(t, "36001405a1b2c3d4", bindings[testVolumeName])
+}
+
+func TestMultipathdMaps(t *testing.T) {
+	out := `{
+   "major_version": 0,
+   "minor_version": 1,
+   "maps": [{
+      "name" : "volume-3ee59355",
+      "uuid" : "36001405a1b2c3d4",
+      "sysfs" : "dm-1",
+      "paths" : 2,
+      "dm_st" : "active",
+      "path_groups": [{
+         "selector" : "round-robin 0",
+         "dm_st" : "active",
+         "paths": [{
+            "dev" : "sdb",
+            "dev_t" : "8:16",
+            "dm_st" : "active",
+            "dev_st" : "running",
+            "chk_st" : "ready"
+         },{
+            "dev" : "sdc",
+            "dev_t" : "8:32",
+            "dm_st" : "failed",
+            "dev_st" : "running",
+            "chk_st" : "faulty"
+         }]
+      }]
+   }]
+}`
+	maps, err := parseMultipathdMaps([]byte(out))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(maps))
+	assert.Equal(t, "dm-1", maps[0].Sysfs)
+	assert.Equal(t, []string{"sdb"}, maps[0].livePaths())
+	assert.Nil(t, maps[0].verify("36001405a1b2c3d4"))
+	assert.NotNil(t, maps[0].verify("36001405e5f6a7b8"))
+
+	maps[0].PathGroups[0].Paths[0].CheckState = "faulty"
+	err = maps[0].verify("36001405a1b2c3d4")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "sdc failed/faulty")
+}
+
+func TestMultipathTable(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.restore()
+	dir := sysfsBlock
+	for name, attributes := range map[string][]string{"sdb": {"8:16", "209715200"}, "sdc": {"8:32", "209715200"}, "sdd": {"8:48", "104857600"}} {
+		assert.Nil(t, os.MkdirAll(filepath.Join(dir, name), 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name, "dev"), []byte(attributes[0]+"\n"), 0644))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name, "size"), []byte(attributes[1]+"\n"), 0644))
+	}
+
+	disks := []pathDisk{}
+	for _, path := range []string{"/dev/sdb", "/dev/sdc"} {
+		disk, err := readPathDisk(path)
+		assert.Nil(t, err)
+		disks = append(disks, disk)
+	}
+	table, err := multipathTable(disks)
+	assert.Nil(t, err)
+	assert.Equal(t, "0 209715200 multipath 0 0 1 1 round-robin 0 2 1 8:16 1 8:32 1", table)
+
+	// paths of another size are not of the same volume
+	disk, err := readPathDisk("/dev/sdd")
+	assert.Nil(t, err)
+	_, err = multipathTable(append(disks, disk))
+	assert.NotNil(t, err)
+	_, err = multipathTable(nil)
+	assert.NotNil(t, err)
+	_, err = readPathDisk("/dev/sde")
+	assert.NotNil(t, err)
+}
+
+func TestHostExecCommand(t *testing.T) {
+	_, err := parseHostPaths([]string{"/usr/sbin/multipath"})
+	assert.NotNil(t, err)
+	_, err = parseHostPaths([]string{"multipath="})
+	assert.NotNil(t, err)
+
+	// the paths of the layout's tools are the layout's, the others are the exec config's
+	options := Options{HostLayout: HostLayoutClassic, HostPaths: []string{"multipath=/usr/sbin/multipath", "mkfs.ext4=/usr/sbin/mkfs.ext4"}}
+	config, err := options.hostExec()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"mkfs.ext4": "/usr/sbin/mkfs.ext4"}, config.tools)
+	configured, err := options.nodeHost()
+	assert.Nil(t, err)
+	selected := configured.layout
+	assert.Equal(t, "/usr/sbin/multipath", selected.multipathExec)
+	assert.Equal(t, "/lib/udev/scsi_id", selected.scsiID)
+
+	assert.Equal(t, []string{"/usr/sbin/mkfs.ext4", "-F", "/dev/sdb"}, config.command(context.TODO(), "mkfs.ext4", "-F", "/dev/sdb").Args)
+	assert.Equal(t, "/usr/sbin/multipath", config.hostPath(config.toolPath(selected.multipathExec)))
+
+	config.mode = ExecNsenter
+	assert.Equal(t, []string{"nsenter", "--target", "1", "--mount", "--", "iscsiadm", "--mode", "session"}, config.command(context.TODO(), "iscsiadm", "--mode", "session").Args)
+	assert.Equal(t, "/proc/1/root/usr/sbin/multipath", config.hostPath(config.toolPath(selected.multipathExec)))
+
+	config.mode = ExecChroot
+	assert.Equal(t, []string{"chroot", "/host", "/usr/sbin/multipath", "-f", testVolumeName}, config.command(context.TODO(), selected.multipathExec, "-f", testVolumeName).Args)
+	assert.Equal(t, "/host/usr/sbin/multipath", config.hostPath(config.toolPath(selected.multipathExec)))
+
+	_, err = NewPacketDriver("unix:///csi/csi.sock", "node1", "", Options{ExecMode: "docker"})
+	assert.NotNil(t, err)
+	_, err = NewPacketDriver("unix:///csi/csi.sock", "node1", "", Options{HostLayout: "plan9"})
+	assert.NotNil(t, err)
+	_, err = NewPacketDriver("unix:///csi/csi.sock", "node1", "", Options{HostPaths: []string{"scsi_id"}})
+	assert.NotNil(t, err)
+
+	// the driver keeps the host for its node helpers
+	driver, err := NewPacketDriver("unix:///csi/csi.sock", "node1", "", options)
+	assert.Nil(t, err)
+	assert.Equal(t, configured, driver.host)
+}
+
+func TestHostExecChrootMount(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.restore()
+	host.exec = hostExecConfig{mode: ExecChroot, hostRoot: DefaultHostRoot}
+	host.layout = hostLayouts[HostLayoutClassic]
+
+	// the mount is made in the plugin, at the staging path it checks, while mkfs is the host's
+	staging := "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount"
+	mounter := &execMounter{host: host.nodeHost}
+	assert.Nil(t, mounter.Format("/dev/mapper/"+testVolumeName, "ext4", nil))
+	assert.Nil(t, mounter.Mount("/dev/mapper/"+testVolumeName, staging, "ext4", []string{"noatime"}))
+	assert.Nil(t, mounter.Unmount(staging))
+	assert.Equal(t, []string{
+		"chroot /host mkfs.ext4 -F /dev/mapper/" + testVolumeName,
+		"mount -t ext4 -o noatime --source /dev/mapper/" + testVolumeName + " --target " + staging,
+		"umount " + staging,
+	}, host.ran())
+
+	assert.Equal(t, "/host/etc/multipath/bindings", host.bindingsPath())
+}
+
+func TestHostLayout(t *testing.T) {
+	id, version := parseOSRelease([]byte(`NAME="Ubuntu"
+VERSION_ID="22.04"
+ID=ubuntu
+ID_LIKE=debian
+`))
+	assert.Equal(t, "ubuntu", id)
+	assert.Equal(t, 22, version)
+	name, ok := osReleaseLayout(id, version)
+	assert.True(t, ok)
+	assert.Equal(t, HostLayoutUsrMerged, name)
+	name, _ = osReleaseLayout("ubuntu", 18)
+	assert.Equal(t, HostLayoutClassic, name)
+	name, _ = osReleaseLayout("debian", 11)
+	assert.Equal(t, HostLayoutClassic, name)
+	name, _ = osReleaseLayout("debian", 12)
+	assert.Equal(t, HostLayoutUsrMerged, name)
+	id, _ = parseOSRelease([]byte("NAME=\"Flatcar Container Linux by Kinvolk\"\nID=flatcar\nVERSION_ID=3510.2.0\n"))
+	name, _ = osReleaseLayout(id, 0)
+	assert.Equal(t, HostLayoutUsrMerged, name)
+	_, ok = osReleaseLayout("plan9", 4)
+	assert.False(t, ok)
+
+	selected, err := newHostLayout(HostLayoutUsrMerged, map[string]string{"multipath-bindings": "/var/lib/multipath/bindings"}, hostExecConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, "/usr/lib/udev/scsi_id", selected.scsiID)
+	assert.Equal(t, "/usr/sbin/multipath", selected.multipathExec)
+	assert.Equal(t, "/var/lib/multipath/bindings", selected.multipathBindings)
+	assert.Equal(t, "/dev/disk/by-path/", selected.diskByPath)
+
+	_, err = newHostLayout("plan9", nil, hostExecConfig{})
+	assert.NotNil(t, err)
+	_, err = Options{HostPaths: []string{"scsi_id"}}.nodeHost()
+	assert.NotNil(t, err)
+
+	// the layout is detected from the os-release of the host root
+	host := newFakeHost(t)
+	defer host.restore()
+	assert.Nil(t, os.MkdirAll(filepath.Join(host.dir, "etc"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(host.dir, "etc", "os-release"), []byte("ID=rocky\nVERSION_ID=\"9.3\"\n"), 0644))
+	selected, err = newHostLayout(HostLayoutAuto, nil, hostExecConfig{mode: ExecChroot, hostRoot: host.dir})
+	assert.Nil(t, err)
+	assert.Equal(t, HostLayoutUsrMerged, selected.name)
+}
+
+func TestMultipathDaemonCreate(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.restore()
+
+	// multipathd names the map by its own configuration, until it is renamed
+	name, present := "mpatha", true
+	host.run = func(command string) ([]byte, error) {
+		switch command {
+		case "multipathd show maps json":
+			if !present {
+				return []byte(`{"maps": []}`), nil
+			}
+			return []byte(`{"maps": [{"name": "` + name + `", "uuid": "36001405a1b2c3d4", "sysfs": "dm-1", "dm_st": "active",
+				"path_groups": [{"paths": [{"dev": "sdb", "dm_st": "active", "chk_st": "ready"}]}]}]}`), nil
+		case "dmsetup rename mpatha " + testVolumeName:
+			name = testVolumeName
+		case "multipathd del map mpatha":
+			present = false
+		}
+		return []byte("ok\n"), nil
+	}
+
+	backend := &multipathDaemon{host: host.nodeHost}
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+	defer cancel()
+	assert.Nil(t, backend.Create(ctx, testVolumeName, "36001405a1b2c3d4", "/dev/sdb"))
+	assert.Equal(t, []string{
+		"multipathd add path sdb",
+		"multipathd add map 36001405a1b2c3d4",
+		"multipathd show maps json",
+		"dmsetup rename mpatha " + testVolumeName,
+		"multipathd show maps json",
+	}, host.ran(), "multipathd is not reconfigured")
+	_, err := os.Stat(host.layout.multipathBindings)
+	assert.True(t, os.IsNotExist(err), "the bindings are not edited")
+
+	// a map which multipathd named back after a reconfiguration is given the alias again
+	name = "mpatha"
+	assert.Nil(t, backend.restoreAlias(ctx, testVolumeName, "36001405a1b2c3d4"))
+	assert.Equal(t, "dmsetup rename mpatha "+testVolumeName, host.ran()[len(host.ran())-1])
+	assert.Equal(t, testVolumeName, name)
+
+	// a map which is not removed is reported
+	created := len(host.ran())
+	assert.NotNil(t, backend.Remove(testVolumeName, ""))
+	assert.Equal(t, "multipathd del map "+testVolumeName, host.ran()[created+1])
+
+	// a map which lost its alias is found by its wwid
+	name = "mpatha"
+	assert.Nil(t, backend.Remove(testVolumeName, "36001405a1b2c3d4"))
+	assert.False(t, present)
+
+	// multipathd reports failure in its output
+	host.run = func(command string) ([]byte, error) {
+		return []byte("fail\n"), nil
+	}
+	assert.NotNil(t, backend.Create(ctx, testVolumeName, "36001405a1b2c3d4", "/dev/sdb"))
+}
+
+func TestMultipathDmsetupRemove(t *testing.T) {
+	host := newFakeHost(t)
+	defer host.restore()
+
+	info := "dmsetup info --noheadings --columns --options uuid " + testVolumeName
+	for _, tc := range []struct {
+		name     string
+		info     string
+		infoErr  error
+		removed  bool
+		expected bool
+	}{
+		{name: "map", info: dmsetupUUIDPrefix + "36001405a1b2c3d4\n", removed: true, expected: true},
+		{name: "no map", info: "Device does not exist.\nCommand failed.\n", infoErr: fmt.Errorf("exit status 1"), expected: true},
+		{name: "timeout", infoErr: fmt.Errorf("signal: killed")},
+		{name: "failure", info: "Permission denied\n", infoErr: fmt.Errorf("exit status 1")},
+	} {
+		host.commands = nil
+		host.run = func(command string) ([]byte, error) {
+			if command == info {
+				return []byte(tc.info), tc.infoErr
+			}
+			return []byte{}, nil
+		}
+		err := (&multipathDmsetup{host: host.nodeHost}).Remove(testVolumeName, "")
+		assert.Equal(t, tc.expected, err == nil, tc.name)
+		assert.Equal(t, tc.removed, len(host.ran()) == 2, tc.name)
+	}
+}
+
+func TestParseLsblk(t *testing.T) {
+	lsblkStdout := `{"blockdevices":[{"name":"md126","fstype":"ext4","label":"ROOT","uuid":"afbc32b3-d258-4553-bd1b-4da06768c63f","mountpoint":"/"}]}`
+	blockInfo, err := parseLsblk([]byte(lsblkStdout), "md126")
+	assert.Nil(t, err)
+	assert.Equal(t, "md126", blockInfo.Name)
+	assert.Equal(t, "ext4", blockInfo.FsType)
+	_, err = parseLsblk([]byte(lsblkStdout), "md127")
+	assert.NotNil(t, err)
+
+	// the disk of a by-path link is reported by its kernel name
+	host := newFakeHost(t)
+	defer host.restore()
+	disk := filepath.Join(host.dir, "sdb")
+	link := filepath.Join(host.layout.diskByPath, "ip-10.144.144.226:3260-iscsi-"+testIQN+"-lun-0")
+	assert.Nil(t, ioutil.WriteFile(disk, nil, 0644))
+	assert.Nil(t, os.Symlink(disk, link))
+	host.run = func(command string) ([]byte, error) {
+		return []byte(`{"blockdevices":[{"name":"sdb","fstype":"xfs","label":null,"uuid":"5c2b3f0e-8a1d-4c7e-9f6a-2b1d0e3c4a5f","mountpoint":null}]}`), nil
+	}
+	blockInfo, err = (&execProber{host: host.nodeHost}).GetBlockInfo(link)
+	assert.Nil(t, err)
+	assert.Equal(t, "sdb", blockInfo.Name)
+	assert.Equal(t, "xfs", blockInfo.FsType)
+	assert.Equal(t, []string{"lsblk -J -i --output NAME,FSTYPE,LABEL,UUID,MOUNTPOINT " + link}, host.ran())
+}
@@ -0,0 +1,237 @@
+package driver
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Reconcile modes determine what the node does at startup with iscsi sessions, multipath maps
+// and bindings which no staged volume owns
+const (
+	// ReconcileEnabled logs out of, flushes and deletes whatever is not owned
+	ReconcileEnabled = "enabled"
+	// ReconcileReport only logs what would be cleaned up
+	ReconcileReport = "report"
+	// ReconcileDisabled skips reconciliation
+	ReconcileDisabled = "disabled"
+)
+
+// volumeAliasPrefix begins the multipath aliases of volumes, named for them
+const volumeAliasPrefix = "volume-"
+
+// packetIQNPrefix identifies the iscsi targets of packet volumes, the sessions to other targets are never touched
+const packetIQNPrefix = "iqn.2013-05.com.daterainc:"
+
+// sessionMaps returns the names of the device mapper maps which hold the disks of a session
+func (h nodeHost) sessionMaps(target ISCSITarget) []string {
+	maps := []string{}
+	links, _ := filepath.Glob(filepath.Join(h.layout.diskByPath, "*"+target.Portal+"*"+target.IQN+"*"))
+	for _, link := range links {
+		disk, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			continue
+		}
+		holders, _ := ioutil.ReadDir(filepath.Join(sysfsBlock, filepath.Base(disk), "holders"))
+		for _, holder := range holders {
+			name, err := ioutil.ReadFile(filepath.Join(sysfsBlock, holder.Name(), "dm", "name"))
+			if err == nil {
+				maps = append(maps, strings.TrimSpace(string(name)))
+			}
+		}
+	}
+	return maps
+}
+
+// mountedMaps returns the names of the device mapper maps which are mounted, or bind mounted as block devices
+func mountedMaps(mounter Mounter, prober BlockDeviceProber) (map[string]bool, error) {
+	mounts, err := mounter.Mounts()
+	if err != nil {
+		return nil, err
+	}
+
+	mapped := map[string]bool{}
+	devices := map[string]bool{}
+	for _, mount := range mounts {
+		devices[filepath.Base(mount.Root)] = true
+		if strings.HasPrefix(mount.Source, "/dev/mapper/") {
+			mapped[filepath.Base(mount.Source)] = true
+		}
+	}
+	for _, name := range listMaps() {
+		device, err := prober.ResolveDevice(mappedDevicePath(name))
+		if err == nil && devices[filepath.Base(device)] {
+			mapped[name] = true
+		}
+	}
+	return mapped, nil
+}
+
+// listMaps returns the multipath maps this driver may have created, either named for the volume
+// or given a default mpath name
+func listMaps() []string {
+	maps := []string{}
+	files, _ := ioutil.ReadDir("/dev/mapper/")
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), "volume-") || strings.HasPrefix(file.Name(), "mpath") {
+			maps = append(maps, file.Name())
+		}
+	}
+	return maps
+}
+
+// reconcilePlan is what reconcile cleans up
+type reconcilePlan struct {
+	// maps are the unowned maps over the disks of packet sessions
+	maps []string
+	// aliases are the unowned volume aliases in the bindings
+	aliases []string
+	// sessions and nodeRecords are the unowned ones of packet targets
+	sessions    []ISCSITarget
+	nodeRecords []ISCSITarget
+}
+
+// planReconcile compares the staged volume records with the multipath bindings, the iscsi sessions and
+// the mount table. A volume is owned if it has a record, or if its map is mounted, as for volumes staged
+// before records were kept. Only the maps over the disks of packet sessions and the aliases of volumes
+// are considered, those of the host are never touched
+func (nodeServer *PacketNodeServer) planReconcile(logger *logrus.Entry) (*reconcilePlan, int, error) {
+	records, err := nodeServer.state.list()
+	if err != nil {
+		return nil, 0, err
+	}
+	mounted, err := mountedMaps(nodeServer.mounter, nodeServer.prober)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ownedMaps := map[string]bool{}
+	ownedTargets := map[ISCSITarget]bool{}
+	for _, record := range records {
+		ownedMaps[record.MultipathAlias] = true
+		for _, portal := range record.Portals {
+			ownedTargets[ISCSITarget{Portal: portal, IQN: record.IQN}] = true
+		}
+	}
+	for name := range mounted {
+		if !ownedMaps[name] {
+			logger.WithField("map", name).Info("mounted map has no record, keeping it")
+		}
+		ownedMaps[name] = true
+	}
+
+	current, err := nodeServer.iscsi.Sessions()
+	if err != nil {
+		return nil, 0, err
+	}
+	plan := &reconcilePlan{}
+	sessions := []ISCSITarget{}
+	packetMaps := map[string]bool{}
+	for _, session := range current {
+		if !strings.HasPrefix(session.IQN, packetIQNPrefix) {
+			continue
+		}
+		sessions = append(sessions, session)
+		for _, name := range nodeServer.host.sessionMaps(session) {
+			packetMaps[name] = true
+			if ownedMaps[name] {
+				ownedTargets[session] = true
+			}
+		}
+	}
+	for name := range packetMaps {
+		if !ownedMaps[name] {
+			plan.maps = append(plan.maps, name)
+		}
+	}
+	sort.Strings(plan.maps)
+
+	bindings, _, err := nodeServer.host.readBindings()
+	if err != nil {
+		return nil, 0, err
+	}
+	for name := range bindings {
+		if strings.HasPrefix(name, volumeAliasPrefix) && !ownedMaps[name] {
+			plan.aliases = append(plan.aliases, name)
+		}
+	}
+	sort.Strings(plan.aliases)
+
+	for _, session := range sessions {
+		if !ownedTargets[session] {
+			plan.sessions = append(plan.sessions, session)
+		}
+	}
+	nodeRecords, err := nodeServer.iscsi.NodeRecords()
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, node := range nodeRecords {
+		if strings.HasPrefix(node.IQN, packetIQNPrefix) && !ownedTargets[node] {
+			plan.nodeRecords = append(plan.nodeRecords, node)
+		}
+	}
+	return plan, len(records), nil
+}
+
+// reconcile cleans up after a restart of the plugin or of the host, what no staged volume owns
+func (nodeServer *PacketNodeServer) reconcile(reportOnly bool) error {
+	logger := nodeServer.Driver.Logger.WithFields(logrus.Fields{"method": "reconcile", "report_only": reportOnly})
+
+	plan, volumes, err := nodeServer.planReconcile(logger)
+	if err != nil {
+		return err
+	}
+
+	act := func(fields logrus.Fields, action string, f func() error) {
+		entry := logger.WithFields(fields)
+		if reportOnly {
+			entry.Infof("would %s", action)
+			return
+		}
+		entry.Info(action)
+		if err := f(); err != nil {
+			entry.Errorf("%s error, %v", action, err)
+		}
+	}
+
+	// maps are flushed before their sessions are logged out; an unowned map has no record of the backend
+	// which created it, so it is removed by device mapper, which serves for any of them
+	backend := &multipathDmsetup{host: nodeServer.host}
+	for _, name := range plan.maps {
+		name := name
+		act(logrus.Fields{"map": name}, "flush map", func() error {
+			return backend.Remove(name, "")
+		})
+	}
+
+	if len(plan.aliases) > 0 {
+		act(logrus.Fields{"aliases": plan.aliases}, "remove bindings", func() error {
+			return nodeServer.host.modifyBindings(func(table *bindingTable) {
+				for _, name := range plan.aliases {
+					table.remove(name)
+				}
+			})
+		})
+	}
+
+	for _, session := range plan.sessions {
+		session := session
+		act(logrus.Fields{"ip": session.Portal, "iqn": session.IQN}, "log out session", func() error {
+			return nodeServer.iscsi.Logout(session.Portal, session.IQN)
+		})
+	}
+
+	for _, node := range plan.nodeRecords {
+		node := node
+		act(logrus.Fields{"ip": node.Portal, "iqn": node.IQN}, "delete node record", func() error {
+			return nodeServer.iscsi.DeleteNode(node.Portal, node.IQN)
+		})
+	}
+
+	logger.WithField("volumes", volumes).Info("reconcile complete")
+	return nil
+}
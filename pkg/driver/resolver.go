@@ -0,0 +1,124 @@
+package driver
+
+import (
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/packethost/csi-packet/pkg/packet"
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// errNodeNotFound indicates that no packet device corresponds to a csi node id
+var errNodeNotFound = errors.New("node not found")
+
+var deviceIDPattern = regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$")
+
+// nodeResolver maps the node id reported by the csi node plugin to a packet device id.
+// The same resolution is used to attach and to detach, and resolved ids are cached
+// since the mapping is stable for the lifetime of a device
+type nodeResolver struct {
+	provider   packet.VolumeProvider
+	strategies []string
+	mutex      sync.Mutex
+	devices    map[string]string
+}
+
+func newNodeResolver(provider packet.VolumeProvider, strategies []string) *nodeResolver {
+	return &nodeResolver{
+		provider:   provider,
+		strategies: strategies,
+		devices:    map[string]string{},
+	}
+}
+
+// resolve returns the device id for a csi node id, trying each strategy in turn;
+// errNodeNotFound is returned if there is no match. The lock is not held while the device
+// list is retrieved, so that a slow api holds up only the resolution which needs it
+func (r *nodeResolver) resolve(csiNodeID string) (string, error) {
+	r.mutex.Lock()
+	cachedID, ok := r.devices[csiNodeID]
+	r.mutex.Unlock()
+	if ok {
+		return cachedID, nil
+	}
+
+	// the device list is only retrieved if a strategy needs it
+	var nodes []packngo.Device
+	getNodes := func() ([]packngo.Device, error) {
+		if nodes != nil {
+			return nodes, nil
+		}
+		devices, httpResponse, err := r.provider.GetNodes()
+		if err != nil {
+			return nil, err
+		}
+		if httpResponse.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("bad status from get nodes, %s", httpResponse.Status)
+		}
+		nodes = devices
+		return nodes, nil
+	}
+
+	for _, strategy := range r.strategies {
+		var deviceID string
+		switch strategy {
+		case NodeIDDeviceID:
+			if deviceIDPattern.MatchString(csiNodeID) {
+				deviceID = csiNodeID
+			}
+		case NodeIDHostname:
+			devices, err := getNodes()
+			if err != nil {
+				return "", err
+			}
+			for _, node := range devices {
+				if node.Hostname == csiNodeID {
+					deviceID = node.ID
+					break
+				}
+			}
+		case NodeIDIP:
+			devices, err := getNodes()
+			if err != nil {
+				return "", err
+			}
+			for _, node := range devices {
+				for _, ipAssignment := range node.Network {
+					if ipAssignment.Address == csiNodeID {
+						deviceID = node.ID
+					}
+				}
+				if deviceID != "" {
+					break
+				}
+			}
+		}
+		if deviceID != "" {
+			log.WithFields(log.Fields{"node_id": csiNodeID, "device_id": deviceID, "strategy": strategy}).Info("node resolved")
+			r.mutex.Lock()
+			r.devices[csiNodeID] = deviceID
+			r.mutex.Unlock()
+			return deviceID, nil
+		}
+	}
+
+	return "", errors.Wrapf(errNodeNotFound, "node id %s", csiNodeID)
+}
+
+// cached reports whether a resolution of the csi node id is cached
+func (r *nodeResolver) cached(csiNodeID string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, ok := r.devices[csiNodeID]
+	return ok
+}
+
+// forget drops a cached resolution, so that the next call consults the device list again
+func (r *nodeResolver) forget(csiNodeID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.devices, csiNodeID)
+}
@@ -0,0 +1,133 @@
+package driver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultStateDir is under the kubelet directory, which the node plugin shares with the host,
+// so that records survive restarts of the plugin
+const DefaultStateDir = "/var/lib/kubelet/plugins/net.packet.csi/state"
+
+// stagedVolume records what the node set up to stage a volume, so that it can be torn down
+// once the volume has gone from the metadata service
+type stagedVolume struct {
+	VolumeID       string   `json:"volumeId"`
+	VolumeName     string   `json:"volumeName"`
+	IQN            string   `json:"iqn"`
+	Portals        []string `json:"portals"`
+	MultipathAlias string   `json:"multipathAlias"`
+	// Multipath is the backend which created the map, the multipath tool for records which predate it
+	Multipath string `json:"multipath,omitempty"`
+	// Device is the device which was formatted and mounted, the map of the alias for records which predate it
+	Device string `json:"device,omitempty"`
+	// WWID is the scsi id of the volume's disks, by which a map which lost its alias is found
+	WWID              string `json:"wwid,omitempty"`
+	StagingTargetPath string `json:"stagingTargetPath"`
+}
+
+// devicePath returns the path of the staged device
+func (v *stagedVolume) devicePath() string {
+	if v.Device == "" {
+		return mappedDevicePath(v.MultipathAlias)
+	}
+	return v.Device
+}
+
+// stateStore keeps one json file per staged volume in a directory
+type stateStore struct {
+	dir string
+}
+
+func newStateStore(dir string) *stateStore {
+	if dir == "" {
+		dir = DefaultStateDir
+	}
+	return &stateStore{dir: dir}
+}
+
+func (s *stateStore) path(volumeName string) string {
+	return filepath.Join(s.dir, volumeName+".json")
+}
+
+// save writes the record to a temporary file and renames it, so that a record is never partially written
+func (s *stateStore) save(volume stagedVolume) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(volume)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.dir, ".tmp-"+volume.VolumeName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path(volume.VolumeName))
+}
+
+// load returns the record for a volume, or nil if there is none
+func (s *stateStore) load(volumeName string) (*stagedVolume, error) {
+	data, err := ioutil.ReadFile(s.path(volumeName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	volume := &stagedVolume{}
+	if err = json.Unmarshal(data, volume); err != nil {
+		return nil, err
+	}
+	return volume, nil
+}
+
+// list returns all records
+func (s *stateStore) list() ([]stagedVolume, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	volumes := []stagedVolume{}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		volume, err := s.load(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if volume != nil {
+			volumes = append(volumes, *volume)
+		}
+	}
+	return volumes, nil
+}
+
+// remove deletes the record for a volume, if there is one
+func (s *stateStore) remove(volumeName string) error {
+	err := os.Remove(s.path(volumeName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
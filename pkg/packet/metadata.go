@@ -0,0 +1,220 @@
+package packet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMetadataEndpoint is the metadata service, reachable from every packet device
+	DefaultMetadataEndpoint = "https://metadata.packet.net/metadata"
+	// DefaultMetadataTimeout bounds each metadata request
+	DefaultMetadataTimeout = 10 * time.Second
+	// DefaultMetadataRetries is the number of further attempts after a failed request
+	DefaultMetadataRetries = 3
+	// DefaultMetadataCacheTTL is how long a response is reused, so that one staging makes one request
+	DefaultMetadataCacheTTL = 5 * time.Second
+
+	metadataRetryInterval = time.Second
+)
+
+// ErrVolumeNotFound indicates that the metadata lists no volume of the name, as before it is attached
+var ErrVolumeNotFound = errors.New("volume not found in metadata")
+
+// {
+// 	"ips": [
+// 	  "10.144.144.144",
+// 	  "10.144.145.66"
+// 	],
+// 	"name": "volume-4b6ed3d8",
+// 	"capacity": {
+// 	  "size": "100",
+// 	  "unit": "gb"
+// 	},
+// 	"iqn": "iqn.2013-05.com.daterainc:tc:01:sn:b06f15a423fec58b"
+// }
+
+// PacketCapacityMetaData exists for parsing json metadata
+type PacketCapacityMetaData struct {
+	Size string `json:"size"`
+	Unit string `json:"unit"`
+}
+
+// PacketVolumeMetadata exists for parsing json metadata
+type PacketVolumeMetadata struct {
+	Name     string                 `json:"name"`
+	IPs      []net.IP               `json:"ips"`
+	Capacity PacketCapacityMetaData `json:"capacity"`
+	IQN      string                 `json:"iqn"`
+}
+
+// PacketDeviceMetadata is the part of the device metadata used by the driver
+type PacketDeviceMetadata struct {
+	ID       string                 `json:"id"`
+	Hostname string                 `json:"hostname"`
+	Facility string                 `json:"facility"`
+	Volumes  []PacketVolumeMetadata `json:"volumes"`
+}
+
+// MetadataClient reads the metadata of the device on which it runs, the requests and their retries
+// being abandoned when the context is done
+type MetadataClient interface {
+	GetDevice(ctx context.Context) (PacketDeviceMetadata, error)
+	// GetVolume returns ErrVolumeNotFound if the volume is not listed
+	GetVolume(ctx context.Context, volumeName string) (PacketVolumeMetadata, error)
+	GetFacilityCode(ctx context.Context) (string, error)
+}
+
+// MetadataConfig holds the metadata client settings, zero values are replaced by defaults
+type MetadataConfig struct {
+	Endpoint string
+	Timeout  time.Duration
+	Retries  int
+	CacheTTL time.Duration
+}
+
+type metadataClient struct {
+	config MetadataConfig
+	client *http.Client
+	// mutex guards the cached response only, it is not held across requests
+	mutex   sync.Mutex
+	device  *PacketDeviceMetadata
+	fetched time.Time
+}
+
+var _ MetadataClient = &metadataClient{}
+
+// NewMetadataClient returns a client of the metadata service
+func NewMetadataClient(config MetadataConfig) MetadataClient {
+	if config.Endpoint == "" {
+		config.Endpoint = DefaultMetadataEndpoint
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultMetadataTimeout
+	}
+	if config.Retries < 0 {
+		config.Retries = 0
+	}
+	if config.CacheTTL < 0 {
+		config.CacheTTL = 0
+	}
+	return &metadataClient{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+	}
+}
+
+// GetDevice returns the device metadata, from the cache if it is fresh
+func (m *metadataClient) GetDevice(ctx context.Context) (PacketDeviceMetadata, error) {
+	return m.getDevice(ctx, false)
+}
+
+// GetVolume looks for the volume in the cached metadata, then in a fresh response since the
+// volume may have been attached since the cache was filled
+func (m *metadataClient) GetVolume(ctx context.Context, volumeName string) (PacketVolumeMetadata, error) {
+	for _, refresh := range []bool{false, true} {
+		device, err := m.getDevice(ctx, refresh)
+		if err != nil {
+			return PacketVolumeMetadata{}, err
+		}
+		for _, volume := range device.Volumes {
+			if volume.Name == volumeName {
+				return volume, nil
+			}
+		}
+	}
+	return PacketVolumeMetadata{}, errors.Wrapf(ErrVolumeNotFound, "volume %s", volumeName)
+}
+
+// GetFacilityCode returns the code of the facility in which the device runs
+func (m *metadataClient) GetFacilityCode(ctx context.Context) (string, error) {
+	device, err := m.getDevice(ctx, false)
+	if err != nil {
+		return "", err
+	}
+	if device.Facility == "" {
+		return "", fmt.Errorf("Unable to read facility code")
+	}
+	return device.Facility, nil
+}
+
+// cached returns the cached response, if it is fresh
+func (m *metadataClient) cached() (PacketDeviceMetadata, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.device != nil && time.Since(m.fetched) < m.config.CacheTTL {
+		return *m.device, true
+	}
+	return PacketDeviceMetadata{}, false
+}
+
+// getDevice returns the cached response, or else requests the metadata, retrying until the context is done;
+// concurrent callers may each make a request, rather than wait on one another
+func (m *metadataClient) getDevice(ctx context.Context, refresh bool) (PacketDeviceMetadata, error) {
+	if !refresh {
+		if device, ok := m.cached(); ok {
+			return device, nil
+		}
+	}
+
+	var device PacketDeviceMetadata
+	var err error
+	for attempt := 0; attempt <= m.config.Retries; attempt++ {
+		if attempt > 0 {
+			log.WithFields(log.Fields{"endpoint": m.config.Endpoint, "attempt": attempt, "error": err}).Info("retrying metadata request")
+			select {
+			case <-ctx.Done():
+				return PacketDeviceMetadata{}, errors.Wrapf(err, "metadata request abandoned, %v", ctx.Err())
+			case <-time.After(metadataRetryInterval):
+			}
+		}
+		var retry bool
+		device, retry, err = m.fetch(ctx)
+		if err == nil || !retry {
+			break
+		}
+	}
+	if err != nil {
+		return PacketDeviceMetadata{}, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.device = &device
+	m.fetched = time.Now()
+	return device, nil
+}
+
+// fetch makes one request, reporting whether a failure may be retried
+func (m *metadataClient) fetch(ctx context.Context) (PacketDeviceMetadata, bool, error) {
+	device := PacketDeviceMetadata{}
+	req, err := http.NewRequest(http.MethodGet, m.config.Endpoint, nil)
+	if err != nil {
+		return device, false, errors.Wrap(err, "metadata request")
+	}
+	res, err := m.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return device, true, errors.Wrap(err, "metadata request")
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return device, true, errors.Wrap(err, "metadata read")
+	}
+	if res.StatusCode != http.StatusOK {
+		return device, res.StatusCode >= http.StatusInternalServerError, errors.Errorf("bad status from metadata, %s", res.Status)
+	}
+	if err = json.Unmarshal(body, &device); err != nil {
+		return device, false, errors.Wrap(err, "metadata decode")
+	}
+	return device, false, nil
+}
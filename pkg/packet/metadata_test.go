@@ -0,0 +1,128 @@
+package packet
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+const deviceMetadata = `{
+	"id": "6b7f3a0b-ee1b-4d0b-9a8d-4d4e1d56a8e4",
+	"hostname": "node1",
+	"facility": "ewr1",
+	"volumes": [{
+		"ips": ["10.144.144.144", "10.144.145.66"],
+		"name": "volume-4b6ed3d8",
+		"capacity": {"size": "100", "unit": "gb"},
+		"iqn": "iqn.2013-05.com.daterainc:tc:01:sn:b06f15a423fec58b"
+	}]
+}`
+
+func TestMetadataClient(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, deviceMetadata)
+	}))
+	defer server.Close()
+
+	client := NewMetadataClient(MetadataConfig{Endpoint: server.URL, CacheTTL: time.Minute})
+
+	device, err := client.GetDevice(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, "6b7f3a0b-ee1b-4d0b-9a8d-4d4e1d56a8e4", device.ID)
+	assert.Equal(t, "node1", device.Hostname)
+
+	facility, err := client.GetFacilityCode(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, "ewr1", facility)
+
+	volume, err := client.GetVolume(context.TODO(), "volume-4b6ed3d8")
+	assert.Nil(t, err)
+	assert.Equal(t, "iqn.2013-05.com.daterainc:tc:01:sn:b06f15a423fec58b", volume.IQN)
+	assert.Equal(t, 2, len(volume.IPs))
+	assert.Equal(t, "10.144.145.66", volume.IPs[1].String())
+	assert.Equal(t, 1, requests, "responses are cached")
+
+	// a volume missing from the cache is looked for in a fresh response
+	_, err = client.GetVolume(context.TODO(), "volume-00000000")
+	assert.Equal(t, ErrVolumeNotFound, errors.Cause(err))
+	assert.Equal(t, 2, requests)
+}
+
+func TestMetadataClientRetries(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, deviceMetadata)
+	}))
+	defer server.Close()
+
+	client := NewMetadataClient(MetadataConfig{Endpoint: server.URL, Retries: 1})
+	facility, err := client.GetFacilityCode(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, "ewr1", facility)
+	assert.Equal(t, 2, requests)
+
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	client = NewMetadataClient(MetadataConfig{Endpoint: notFound.URL, Retries: 3})
+	_, err = client.GetDevice(context.TODO())
+	assert.NotNil(t, err, "client errors are not retried")
+}
+
+func TestMetadataClientCancel(t *testing.T) {
+	var mutex sync.Mutex
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, deviceMetadata)
+	}))
+	defer server.Close()
+
+	client := NewMetadataClient(MetadataConfig{Endpoint: server.URL, Retries: 3, CacheTTL: time.Minute})
+	_, err := client.GetDevice(context.TODO())
+	assert.Nil(t, err)
+	mutex.Lock()
+	failing = true
+	mutex.Unlock()
+
+	// a volume missing from the cache is retried until the context is done, meanwhile the cache is served
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		_, err := client.GetVolume(ctx, "volume-00000000")
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	device, err := client.GetDevice(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, "node1", device.Hostname)
+	assert.True(t, time.Since(start) < 50*time.Millisecond, "the cache is not held by the retries")
+
+	select {
+	case err = <-done:
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "abandoned")
+	case <-time.After(time.Second):
+		t.Error("the retries outlast the context")
+	}
+}
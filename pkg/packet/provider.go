@@ -1,8 +1,13 @@
 package packet
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -20,10 +25,20 @@ type Config struct {
 	AuthToken  string `json:"auth-token"`
 	ProjectID  string `json:"project-id"`
 	FacilityID string `json:"facility-id"`
+	// BaseURL overrides the Packet API endpoint, e.g. an internal gateway or a local test server
+	BaseURL string `json:"base-url,omitempty"`
+	// HTTPProxy is the proxy used for API requests, the environment settings are used if empty
+	HTTPProxy string `json:"http-proxy,omitempty"`
+	// CABundle is the path to a PEM file of additional certificate authorities trusted for API requests
+	CABundle string `json:"ca-bundle,omitempty"`
+	// RequestTimeout bounds each API request, as a duration string such as "30s"
+	RequestTimeout string `json:"request-timeout,omitempty"`
 }
 
 type PacketVolumeProvider struct {
-	config Config
+	config   Config
+	client   *packngo.Client
+	metadata MetadataClient
 }
 
 var _ VolumeProvider = &PacketVolumeProvider{}
@@ -34,7 +49,9 @@ func VolumeIDToName(id string) string {
 	return fmt.Sprintf("volume-%s", uuidElements[0])
 }
 
-func NewPacketProvider(config Config) (*PacketVolumeProvider, error) {
+// NewPacketProvider returns a provider for the configured project; the metadata client finds the facility
+// if none is configured
+func NewPacketProvider(config Config, metadata MetadataClient) (*PacketVolumeProvider, error) {
 	if config.AuthToken == "" {
 		return nil, errors.New("AuthToken not specified")
 	}
@@ -44,16 +61,21 @@ func NewPacketProvider(config Config) (*PacketVolumeProvider, error) {
 	logger := log.WithFields(log.Fields{"project_id": config.ProjectID})
 	logger.Info("Creating provider")
 
+	c, err := constructClient(config)
+	if err != nil {
+		logger.Errorf("Cannot create client %v", err)
+		return nil, errors.Wrap(err, "cannot construct PacketVolumeProvider")
+	}
+
 	if config.FacilityID == "" {
-		facilityCode, err := GetPacketFacilityCodeMetadata()
+		facilityCode, err := metadata.GetFacilityCode(context.Background())
 		if err != nil {
 			logger.Errorf("Cannot get facility code %v", err)
 			return nil, errors.Wrap(err, "cannot construct PacketVolumeProvider")
 		}
-		c := constructClient(config.AuthToken)
 		facilities, resp, err := c.Facilities.List()
 		if err != nil {
-			if resp.StatusCode == http.StatusForbidden {
+			if resp != nil && resp.StatusCode == http.StatusForbidden {
 				return nil, fmt.Errorf("cannot construct PacketVolumeProvider, access denied to search facilities")
 			}
 			return nil, errors.Wrap(err, "cannot construct PacketVolumeProvider")
@@ -71,40 +93,90 @@ func NewPacketProvider(config Config) (*PacketVolumeProvider, error) {
 		return nil, fmt.Errorf("FacilityID not specified and cannot be found")
 	}
 
-	provider := PacketVolumeProvider{config}
+	provider := PacketVolumeProvider{config: config, client: c, metadata: metadata}
 	return &provider, nil
 }
 
-func constructClient(authToken string) *packngo.Client {
+// constructClient builds the API client from the config, it is shared by all calls made by the provider
+// so that connections are kept alive between requests
+func constructClient(config Config) (*packngo.Client, error) {
 	tr := &http.Transport{
+		Proxy:              http.ProxyFromEnvironment,
 		MaxIdleConns:       10,
 		IdleConnTimeout:    30 * time.Second,
 		DisableCompression: true,
 	}
+	if config.HTTPProxy != "" {
+		proxyURL, err := url.Parse(config.HTTPProxy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid http-proxy %s", config.HTTPProxy)
+		}
+		tr.Proxy = http.ProxyURL(proxyURL)
+	}
+	if config.CABundle != "" {
+		pem, err := ioutil.ReadFile(config.CABundle)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read ca-bundle %s", config.CABundle)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in ca-bundle %s", config.CABundle)
+		}
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
 	client := &http.Client{Transport: tr}
+	if config.RequestTimeout != "" {
+		timeout, err := time.ParseDuration(config.RequestTimeout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid request-timeout %s", config.RequestTimeout)
+		}
+		client.Timeout = timeout
+	}
 
 	// client.Transport = logging.NewTransport("Packet", client.Transport)
-	return packngo.NewClientWithAuth(ConsumerToken, authToken, client)
-}
-
-// Client() returns a new client for accessing Packet's API.
-func (p *PacketVolumeProvider) client() *packngo.Client {
-	return constructClient(p.config.AuthToken)
+	if config.BaseURL != "" {
+		return packngo.NewClientWithBaseURL(ConsumerToken, config.AuthToken, client, config.BaseURL)
+	}
+	return packngo.NewClientWithAuth(ConsumerToken, config.AuthToken, client), nil
 }
 
 // ListVolume wraps the packet api as an interface method
 func (p *PacketVolumeProvider) ListVolumes() ([]packngo.Volume, *packngo.Response, error) {
-	return p.client().Volumes.List(p.config.ProjectID, &packngo.ListOptions{})
+	return p.client.Volumes.List(p.config.ProjectID, &packngo.ListOptions{})
+}
+
+// ListVolumesWithAttachments lists the volumes with the device of each attachment, which the api
+// otherwise returns as a bare href
+func (p *PacketVolumeProvider) ListVolumesWithAttachments() ([]packngo.Volume, *packngo.Response, error) {
+	return p.client.Volumes.List(p.config.ProjectID, &packngo.ListOptions{Includes: "attachments.device"})
 }
 
 // Get wraps the packet api as an interface method
 func (p *PacketVolumeProvider) Get(volumeUUID string) (*packngo.Volume, *packngo.Response, error) {
-	return p.client().Volumes.Get(volumeUUID)
+	return p.client.Volumes.Get(volumeUUID)
+}
+
+// Update wraps the packet api as an interface method
+func (p *PacketVolumeProvider) Update(volumeUUID string, updateRequest *packngo.VolumeUpdateRequest) (*packngo.Volume, *packngo.Response, error) {
+	return p.client.Volumes.Update(volumeUUID, updateRequest)
+}
+
+// GetTargets reads the iscsi targets of a volume from the packet api
+func (p *PacketVolumeProvider) GetTargets(volumeUUID string) (*VolumeTargets, *packngo.Response, error) {
+	targets := &VolumeTargets{}
+	resp, err := p.client.DoRequest("GET", fmt.Sprintf("/storage/%s", volumeUUID), nil, targets)
+	if err != nil {
+		return nil, resp, err
+	}
+	return targets, resp, nil
 }
 
 // Delete wraps the packet api as an interface method
 func (p *PacketVolumeProvider) Delete(volumeUUID string) (*packngo.Response, error) {
-	resp, err := p.client().Volumes.Delete(volumeUUID)
+	resp, err := p.client.Volumes.Delete(volumeUUID)
 	if resp.StatusCode == http.StatusNotFound {
 		return resp, nil
 	}
@@ -116,28 +188,28 @@ func (p *PacketVolumeProvider) Create(createRequest *packngo.VolumeCreateRequest
 
 	createRequest.FacilityID = p.config.FacilityID
 
-	return p.client().Volumes.Create(createRequest, p.config.ProjectID)
+	return p.client.Volumes.Create(createRequest, p.config.ProjectID)
 }
 
 // Attach wraps the packet api as an interface method
 func (p *PacketVolumeProvider) Attach(volumeID, deviceID string) (*packngo.VolumeAttachment, *packngo.Response, error) {
-	volume, httpResponse, err := p.client().Volumes.Get(volumeID)
+	volume, httpResponse, err := p.client.Volumes.Get(volumeID)
 	if err != nil || httpResponse.StatusCode != http.StatusOK {
 		return nil, httpResponse, errors.Wrap(err, "prechecking existence of volume attachment")
 	}
 	for _, attachment := range volume.Attachments {
 		if attachment.Device.ID == deviceID {
-			return p.client().VolumeAttachments.Get(attachment.ID)
+			return p.client.VolumeAttachments.Get(attachment.ID)
 		}
 	}
-	return p.client().VolumeAttachments.Create(volumeID, deviceID)
+	return p.client.VolumeAttachments.Create(volumeID, deviceID)
 }
 
 // Detach wraps the packet api as an interface method
 func (p *PacketVolumeProvider) Detach(attachmentId string) (*packngo.Response, error) {
-	return p.client().VolumeAttachments.Delete(attachmentId)
+	return p.client.VolumeAttachments.Delete(attachmentId)
 }
 
 func (p *PacketVolumeProvider) GetNodes() ([]packngo.Device, *packngo.Response, error) {
-	return p.client().Devices.List(p.config.ProjectID, &packngo.ListOptions{})
+	return p.client.Devices.List(p.config.ProjectID, &packngo.ListOptions{})
 }
@@ -1,6 +1,9 @@
 package packet
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -10,3 +13,109 @@ func TestPacketVolumeIDToName(t *testing.T) {
 	name := VolumeIDToName("3ee59355-a51a-42a8-b848-86626cc532f0")
 	assert.Equal(t, name, "volume-3ee59355")
 }
+
+func TestProviderUsesConfiguredBaseURL(t *testing.T) {
+	projectID := "93125c2a-8b78-4d4f-a3c4-7367d6b7cca8"
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, fmt.Sprintf("/projects/%s/storage", projectID), r.URL.Path)
+		assert.Equal(t, "token", r.Header.Get("X-Auth-Token"))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"volumes":[{"id":"3ee59355-a51a-42a8-b848-86626cc532f0","size":100}]}`)
+	}))
+	defer server.Close()
+
+	provider, err := NewPacketProvider(Config{
+		AuthToken:      "token",
+		ProjectID:      projectID,
+		FacilityID:     "e1e9c52e-a0bc-4117-b996-0fc94843ea09",
+		BaseURL:        server.URL,
+		RequestTimeout: "5s",
+	}, nil)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		volumes, resp, err := provider.ListVolumes()
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 1, len(volumes))
+	}
+	assert.Equal(t, 2, requests)
+}
+
+func TestProviderListVolumesWithAttachments(t *testing.T) {
+	projectID := "93125c2a-8b78-4d4f-a3c4-7367d6b7cca8"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, fmt.Sprintf("/projects/%s/storage", projectID), r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		// without the include the api returns each attachment device as a bare href
+		if r.URL.Query().Get("include") != "attachments.device" {
+			fmt.Fprint(w, `{"volumes":[{"id":"3ee59355-a51a-42a8-b848-86626cc532f0","attachments":[{"href":"/storage/attachments/c5b3d4e6-1f2a-4b3c-8d9e-0a1b2c3d4e5f"}]}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"volumes":[{"id":"3ee59355-a51a-42a8-b848-86626cc532f0","attachments":[{"id":"c5b3d4e6-1f2a-4b3c-8d9e-0a1b2c3d4e5f","device":{"id":"8a2f7d3e-0b1c-4e5f-9a6b-7c8d9e0f1a2b"}}]}]}`)
+	}))
+	defer server.Close()
+
+	provider, err := NewPacketProvider(Config{
+		AuthToken:  "token",
+		ProjectID:  projectID,
+		FacilityID: "e1e9c52e-a0bc-4117-b996-0fc94843ea09",
+		BaseURL:    server.URL,
+	}, nil)
+	assert.Nil(t, err)
+
+	volumes, _, err := provider.ListVolumesWithAttachments()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(volumes))
+	assert.Equal(t, 1, len(volumes[0].Attachments))
+	assert.Equal(t, "8a2f7d3e-0b1c-4e5f-9a6b-7c8d9e0f1a2b", volumes[0].Attachments[0].Device.ID)
+}
+
+func TestProviderInvalidClientConfig(t *testing.T) {
+	base := Config{
+		AuthToken:  "token",
+		ProjectID:  "93125c2a-8b78-4d4f-a3c4-7367d6b7cca8",
+		FacilityID: "e1e9c52e-a0bc-4117-b996-0fc94843ea09",
+	}
+
+	timeout := base
+	timeout.RequestTimeout = "soon"
+	_, err := NewPacketProvider(timeout, nil)
+	assert.NotNil(t, err, "invalid request timeout")
+
+	bundle := base
+	bundle.CABundle = "/nonexistent/ca.pem"
+	_, err = NewPacketProvider(bundle, nil)
+	assert.NotNil(t, err, "missing ca bundle")
+
+	proxy := base
+	proxy.HTTPProxy = "://proxy"
+	_, err = NewPacketProvider(proxy, nil)
+	assert.NotNil(t, err, "invalid proxy url")
+}
+
+func TestProviderGetTargets(t *testing.T) {
+	volumeID := "3ee59355-a51a-42a8-b848-86626cc532f0"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, fmt.Sprintf("/storage/%s", volumeID), r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"3ee59355-a51a-42a8-b848-86626cc532f0","iqn":"iqn.2013-05.com.daterainc:tc:01:sn:b06f4c5b0ec7cbe6","ips":["10.144.144.226","10.144.145.66"]}`)
+	}))
+	defer server.Close()
+
+	provider, err := NewPacketProvider(Config{
+		AuthToken:  "token",
+		ProjectID:  "93125c2a-8b78-4d4f-a3c4-7367d6b7cca8",
+		FacilityID: "e1e9c52e-a0bc-4117-b996-0fc94843ea09",
+		BaseURL:    server.URL,
+	}, nil)
+	assert.Nil(t, err)
+
+	targets, resp, err := provider.GetTargets(volumeID)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "iqn.2013-05.com.daterainc:tc:01:sn:b06f4c5b0ec7cbe6", targets.IQN)
+	assert.Equal(t, []string{"10.144.144.226", "10.144.145.66"}, targets.IPs)
+}
@@ -16,21 +16,68 @@ const (
 	VolumePlanStandardID          = "87728148-3155-4992-a730-8d1e6aca8a32"
 	VolumePlanPerformance         = "performance"
 	VolumePlanPerformanceID       = "d6570cfb-38fa-4467-92b3-e45d059bb249"
+	VolumeStateActive             = "active"
+	VolumeStateFailed             = "failed"
+	DeviceStateActive             = "active"
+	// MaxVolumesPerDevice is the number of volumes packet permits to be attached to one device
+	MaxVolumesPerDevice = 8
 )
 
+//go:generate mockgen -source=volume.go -destination=../test/volume_mock.go -package=test
+
 type VolumeProvider interface {
 	ListVolumes() ([]packngo.Volume, *packngo.Response, error)
+	ListVolumesWithAttachments() ([]packngo.Volume, *packngo.Response, error)
 	Get(volumeID string) (*packngo.Volume, *packngo.Response, error)
 	Delete(volumeID string) (*packngo.Response, error)
 	Create(*packngo.VolumeCreateRequest) (*packngo.Volume, *packngo.Response, error)
 	Attach(volumeID, deviceID string) (*packngo.VolumeAttachment, *packngo.Response, error)
 	Detach(attachmentID string) (*packngo.Response, error)
 	GetNodes() ([]packngo.Device, *packngo.Response, error)
+	GetTargets(volumeID string) (*VolumeTargets, *packngo.Response, error)
+	Update(volumeID string, updateRequest *packngo.VolumeUpdateRequest) (*packngo.Volume, *packngo.Response, error)
+}
+
+// VolumeTargets are the iscsi target name and portals of a volume, which packngo does not parse
+type VolumeTargets struct {
+	IQN string   `json:"iqn"`
+	IPs []string `json:"ips"`
 }
 
 type VolumeDescription struct {
 	Name    string
 	Created time.Time
+	// Readers are the devices attached for multi-node read-only access, any other attachment may write
+	Readers []string `json:",omitempty"`
+}
+
+// IsReader reports whether the device is recorded as attached for read-only access
+func (desc VolumeDescription) IsReader(deviceID string) bool {
+	for _, reader := range desc.Readers {
+		if reader == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// SetReader records whether the device is attached for read-only access, reporting whether that changed
+func (desc *VolumeDescription) SetReader(deviceID string, reader bool) bool {
+	if desc.IsReader(deviceID) == reader {
+		return false
+	}
+	if reader {
+		desc.Readers = append(desc.Readers, deviceID)
+		return true
+	}
+	readers := []string{}
+	for _, existing := range desc.Readers {
+		if existing != deviceID {
+			readers = append(readers, existing)
+		}
+	}
+	desc.Readers = readers
+	return true
 }
 
 func (desc VolumeDescription) String() string {
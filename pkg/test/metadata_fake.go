@@ -0,0 +1,49 @@
+package test
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/packethost/csi-packet/pkg/packet"
+	"github.com/pkg/errors"
+)
+
+// FakeMetadataClient serves fixed device metadata, or Err if set
+type FakeMetadataClient struct {
+	Device packet.PacketDeviceMetadata
+	Err    error
+}
+
+var _ packet.MetadataClient = &FakeMetadataClient{}
+
+// GetDevice returns the fixed device metadata
+func (f *FakeMetadataClient) GetDevice(ctx context.Context) (packet.PacketDeviceMetadata, error) {
+	if f.Err != nil {
+		return packet.PacketDeviceMetadata{}, f.Err
+	}
+	return f.Device, nil
+}
+
+// GetVolume returns the named volume from the fixed device metadata
+func (f *FakeMetadataClient) GetVolume(ctx context.Context, volumeName string) (packet.PacketVolumeMetadata, error) {
+	if f.Err != nil {
+		return packet.PacketVolumeMetadata{}, f.Err
+	}
+	for _, volume := range f.Device.Volumes {
+		if volume.Name == volumeName {
+			return volume, nil
+		}
+	}
+	return packet.PacketVolumeMetadata{}, errors.Wrapf(packet.ErrVolumeNotFound, "volume %s", volumeName)
+}
+
+// GetFacilityCode returns the facility of the fixed device metadata
+func (f *FakeMetadataClient) GetFacilityCode(ctx context.Context) (string, error) {
+	if f.Err != nil {
+		return "", f.Err
+	}
+	if f.Device.Facility == "" {
+		return "", fmt.Errorf("Unable to read facility code")
+	}
+	return f.Device.Facility, nil
+}
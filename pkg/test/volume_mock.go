@@ -1,14 +1,14 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: pkg/cloud_provider/volume.go
+// Source: volume.go
 
-// Package mock_cloud_provider is a generated GoMock package.
+// Package test is a generated GoMock package.
 package test
 
 import (
-	reflect "reflect"
-
 	gomock "github.com/golang/mock/gomock"
+	packet "github.com/packethost/csi-packet/pkg/packet"
 	packngo "github.com/packethost/packngo"
+	reflect "reflect"
 )
 
 // MockVolumeProvider is a mock of VolumeProvider interface
@@ -48,6 +48,20 @@ func (mr *MockVolumeProviderMockRecorder) ListVolumes() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListVolumes", reflect.TypeOf((*MockVolumeProvider)(nil).ListVolumes))
 }
 
+// ListVolumesWithAttachments mocks base method
+func (m *MockVolumeProvider) ListVolumesWithAttachments() ([]packngo.Volume, *packngo.Response, error) {
+	ret := m.ctrl.Call(m, "ListVolumesWithAttachments")
+	ret0, _ := ret[0].([]packngo.Volume)
+	ret1, _ := ret[1].(*packngo.Response)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ListVolumesWithAttachments indicates an expected call of ListVolumesWithAttachments
+func (mr *MockVolumeProviderMockRecorder) ListVolumesWithAttachments() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListVolumesWithAttachments", reflect.TypeOf((*MockVolumeProvider)(nil).ListVolumesWithAttachments))
+}
+
 // Get mocks base method
 func (m *MockVolumeProvider) Get(volumeID string) (*packngo.Volume, *packngo.Response, error) {
 	ret := m.ctrl.Call(m, "Get", volumeID)
@@ -130,25 +144,30 @@ func (mr *MockVolumeProviderMockRecorder) GetNodes() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNodes", reflect.TypeOf((*MockVolumeProvider)(nil).GetNodes))
 }
 
-// MockNodeVolumeManager is a mock of NodeVolumeManager interface
-type MockNodeVolumeManager struct {
-	ctrl     *gomock.Controller
-	recorder *MockNodeVolumeManagerMockRecorder
+// GetTargets mocks base method
+func (m *MockVolumeProvider) GetTargets(volumeID string) (*packet.VolumeTargets, *packngo.Response, error) {
+	ret := m.ctrl.Call(m, "GetTargets", volumeID)
+	ret0, _ := ret[0].(*packet.VolumeTargets)
+	ret1, _ := ret[1].(*packngo.Response)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
 }
 
-// MockNodeVolumeManagerMockRecorder is the mock recorder for MockNodeVolumeManager
-type MockNodeVolumeManagerMockRecorder struct {
-	mock *MockNodeVolumeManager
+// GetTargets indicates an expected call of GetTargets
+func (mr *MockVolumeProviderMockRecorder) GetTargets(volumeID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTargets", reflect.TypeOf((*MockVolumeProvider)(nil).GetTargets), volumeID)
 }
 
-// NewMockNodeVolumeManager creates a new mock instance
-func NewMockNodeVolumeManager(ctrl *gomock.Controller) *MockNodeVolumeManager {
-	mock := &MockNodeVolumeManager{ctrl: ctrl}
-	mock.recorder = &MockNodeVolumeManagerMockRecorder{mock}
-	return mock
+// Update mocks base method
+func (m *MockVolumeProvider) Update(volumeID string, updateRequest *packngo.VolumeUpdateRequest) (*packngo.Volume, *packngo.Response, error) {
+	ret := m.ctrl.Call(m, "Update", volumeID, updateRequest)
+	ret0, _ := ret[0].(*packngo.Volume)
+	ret1, _ := ret[1].(*packngo.Response)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
 }
 
-// EXPECT returns an object that allows the caller to indicate expected use
-func (m *MockNodeVolumeManager) EXPECT() *MockNodeVolumeManagerMockRecorder {
-	return m.recorder
+// Update indicates an expected call of Update
+func (mr *MockVolumeProviderMockRecorder) Update(volumeID, updateRequest interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockVolumeProvider)(nil).Update), volumeID, updateRequest)
 }